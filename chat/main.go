@@ -15,15 +15,18 @@ func init() {
 
 type flagArgs struct {
 	Port int
+	GM   string
 }
 
 var Args = flagArgs{}
 
 func beforeMain() {
 	flag.IntVar(&Args.Port, "p", 8888, "指定监听端口")
+	flag.StringVar(&Args.GM, "gm", "", "GM 角色，多个用逗号分开")
 	flag.Parse()
 	gen_routine.BeforeMain()
 	player.BeforeMain()
+	player.SetGM(Args.GM)
 	profanity.BeforeMain()
 }
 
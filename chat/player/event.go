@@ -0,0 +1,144 @@
+package player
+
+import (
+	"fmt"
+	"github.com/huhu401/chat_test/gen_routine"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 聊天服的事件，统一发到 chatEvents，审计、统计、聊天记录以及词频各自挂一个处理
+
+// EventLogin 玩家登陆
+type EventLogin struct {
+	RoleID int64
+}
+
+// EventJoin 玩家进入聊天室
+type EventJoin struct {
+	RoleID int64
+	Grp    int32
+}
+
+// EventChat 玩家发言，Content 是屏蔽过敏感词的
+type EventChat struct {
+	RoleID  int64
+	Grp     int32
+	Content string
+}
+
+// EventModeration 发言里有敏感词被屏蔽了
+type EventModeration struct {
+	RoleID   int64
+	Grp      int32
+	Original string
+	Filtered string
+}
+
+const (
+	eventBatch   = 64
+	eventMailbox = 1024
+	eventTimeout = time.Second
+)
+
+var chatEvents *gen_routine.EventMgr
+
+var eventStats = &eventCounter{}
+
+func startEvents() *gen_routine.Error {
+	em, err := gen_routine.NewEventMgr(gen_routine.RootMgr(), "chat events",
+		gen_routine.WithMailbox(eventMailbox), gen_routine.WithBatch(eventBatch))
+	if err != nil {
+		return err
+	}
+	chatEvents = em
+	handlers := []struct {
+		id string
+		h  gen_routine.EventHandler
+	}{
+		{"history", &historyHandler{}},
+		{"rank", &rankHandler{}},
+		{"audit", &auditHandler{}},
+		{"stats", eventStats},
+	}
+	for _, h := range handlers {
+		if err := em.AddHandler(h.id, h.h, eventTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 聊天记录，排队的发言一次加锁批量写进去
+type historyHandler struct{}
+
+func (h *historyHandler) HandleEvent(event gen_routine.Msg) *gen_routine.Error {
+	return h.HandleEvents([]gen_routine.Msg{event})
+}
+
+func (h *historyHandler) HandleEvents(events []gen_routine.Msg) *gen_routine.Error {
+	history.Lock()
+	defer history.Unlock()
+	for _, e := range events {
+		if v, ok := e.(*EventChat); ok {
+			appendHistory(v.Grp, v.Content)
+		}
+	}
+	return nil
+}
+
+// 词频排行
+type rankHandler struct{}
+
+func (h *rankHandler) HandleEvent(event gen_routine.Msg) *gen_routine.Error {
+	return h.HandleEvents([]gen_routine.Msg{event})
+}
+
+func (h *rankHandler) HandleEvents(events []gen_routine.Msg) *gen_routine.Error {
+	history.Lock()
+	defer history.Unlock()
+	for _, e := range events {
+		if v, ok := e.(*EventChat); ok {
+			updateFrequency(v.Content)
+		}
+	}
+	return nil
+}
+
+// 审计日志
+type auditHandler struct{}
+
+func (h *auditHandler) HandleEvent(event gen_routine.Msg) *gen_routine.Error {
+	switch v := event.(type) {
+	case *EventLogin:
+		log.Println("audit login", v.RoleID)
+	case *EventModeration:
+		log.Println("audit moderation", v.RoleID, "grp", v.Grp, "original", v.Original)
+	}
+	return nil
+}
+
+// 事件计数，gm 命令在玩家协程里直接读
+type eventCounter struct {
+	login, join, chat, moderation uint64
+}
+
+func (c *eventCounter) HandleEvent(event gen_routine.Msg) *gen_routine.Error {
+	switch event.(type) {
+	case *EventLogin:
+		atomic.AddUint64(&c.login, 1)
+	case *EventJoin:
+		atomic.AddUint64(&c.join, 1)
+	case *EventChat:
+		atomic.AddUint64(&c.chat, 1)
+	case *EventModeration:
+		atomic.AddUint64(&c.moderation, 1)
+	}
+	return nil
+}
+
+func (c *eventCounter) String() string {
+	return fmt.Sprintf("login %d join %d chat %d moderation %d", atomic.LoadUint64(&c.login),
+		atomic.LoadUint64(&c.join), atomic.LoadUint64(&c.chat), atomic.LoadUint64(&c.moderation))
+}
@@ -0,0 +1,53 @@
+package player
+
+import (
+	"github.com/huhu401/chat_test/constant"
+	"github.com/huhu401/chat_test/gen_routine"
+	"github.com/huhu401/chat_test/msg"
+	"log"
+	"time"
+)
+
+// 处理超过这个时间的消息打日志
+const slowMsg = time.Millisecond * 100
+
+// 所有玩家协程共用的拦截器，从外到里
+// 崩溃不拦，玩家状态可能只改了一半，还是按框架默认的退出
+func playerInterceptors() []gen_routine.Interceptor {
+	return []gen_routine.Interceptor{logSlow, checkClient}
+}
+
+// 慢消息打日志
+func logSlow(svr *gen_routine.Svr, m gen_routine.Msg, next gen_routine.Handler) (interface{}, *gen_routine.Error) {
+	start := time.Now()
+	ret, err := next(m)
+	if d := time.Since(start); d > slowMsg {
+		log.Printf("slow msg role %v msg %T cost %v", svr.Key(), m, d)
+	}
+	return ret, err
+}
+
+// 客户端消息格式检查，不对的直接拒绝，玩家协程里不用再检查
+func checkClient(svr *gen_routine.Svr, m gen_routine.Msg, next gen_routine.Handler) (interface{}, *gen_routine.Error) {
+	v, ok := m.(*msg.Message)
+	if !ok || validClient(v) {
+		return next(m)
+	}
+	log.Printf("invalid client msg role %v grp %d cmd %d", svr.Key(), v.Grp, v.Cmd)
+	return nil, &gen_routine.Error{Code: gen_routine.ErrorRejected, Param: "invalid client msg"}
+}
+
+func validClient(v *msg.Message) bool {
+	if v.Grp != constant.MsgGrpChat {
+		return true
+	}
+	switch v.Cmd {
+	case constant.MsgCmdChat:
+		req, ok := v.Data.(*msg.ReqMsgChat)
+		return ok && req.Content != ""
+	case constant.MsgCmdJoin:
+		_, ok := v.Data.(*msg.ReqMsgJoin)
+		return ok
+	}
+	return true
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/huhu401/chat_test/constant"
 	"github.com/huhu401/chat_test/gen_routine"
 	"github.com/huhu401/chat_test/msg"
-	"github.com/huhu401/chat_test/profanity"
 	"log"
 	"net"
 	"strconv"
@@ -13,11 +12,25 @@ import (
 	"time"
 )
 
+// IdleTimeout 玩家多久没有客户端消息则回收，tcp 那边断开但是没有收到错误时靠这个清理
+const IdleTimeout = time.Minute * 30
+
+// 查询玩家信息最多等多久
+const statsTimeout = time.Second
+
+// 订阅主题，房间的主题是 room.<房间号>.xxx
+const (
+	TopicServer = "server"
+	TopicRoom   = "room"
+)
+
 // Player 玩家对象
+// 登陆流程是一个状态机：connecting -> authenticated -> in-room -> kicked，见 state.go
 type Player struct {
 	RoleID int64 //玩家RoleId
 	C      net.Conn
 	*gen_routine.Svr
+	*gen_routine.StateMachine
 	chatGrp    int32 // 聊天室编号
 	LoginStamp int64
 }
@@ -26,6 +39,7 @@ type Player struct {
 // 所以这里不能写玩家确定登陆进来的逻辑
 func NewPlayer(req *msg.ReqMsgLogin) *Player {
 	p := &Player{RoleID: req.RoleId}
+	p.StateMachine = gen_routine.NewStateMachine(p)
 	return p
 }
 
@@ -34,39 +48,71 @@ func (p *Player) Stop(reason *gen_routine.Error) {
 	p.StopSvr(reason)
 }
 
+// Connect 登陆成功后把连接交给玩家协程
+func (p *Player) Connect(c net.Conn) {
+	p.Cast(&connect{c: c})
+}
+
+// Kick 踢下线
+func (p *Player) Kick(reason string) {
+	p.Cast(&kick{reason: reason})
+}
+
 func (p *Player) Key() interface{} {
 	return p.RoleID
 }
 
-func (p *Player) Init(svr *gen_routine.Svr) *gen_routine.Error {
+// InitState 协程初始化，等连接交过来
+func (p *Player) InitState(svr *gen_routine.Svr) (gen_routine.State, *gen_routine.Error) {
 	p.Svr = svr
 	p.LoginStamp = time.Now().Unix()
-	return nil
+	// 全服公告
+	if err := p.Subscribe(TopicServer + ".#"); err != nil {
+		return "", err
+	}
+	return StateConnecting, nil
+}
+
+// 只有客户端来的消息算活跃，房间广播、公告这些不算，不然在热闹房间里的死连接永远回收不了
+func clientActive(m gen_routine.Msg) bool {
+	switch m.(type) {
+	case *msg.Message, *connect:
+		return true
+	}
+	return false
+}
+
+// HandleIdle 长时间没有客户端消息，直接下线
+func (p *Player) HandleIdle() *gen_routine.Error {
+	log.Println("player idle timeout", p.LogId())
+	return &gen_routine.Error{Code: gen_routine.ErrorNormalStop, Param: "idle timeout"}
 }
 
 func (p *Player) alreadyIn(req *msg.ReqMsgLogin) {
 	log.Println("player already in", p.LogId(), "req", req)
 }
 
-// Terminate 协程内调过来的退出操作
-func (p *Player) Terminate(rea *gen_routine.Error) {
-	p.GrpByeBye()
-	err := p.C.Close()
+// TerminateState 协程内调过来的退出操作
+// 退出的分组由框架自动清理，房间里的其他人会收到带退出原因的离开通知
+func (p *Player) TerminateState(state gen_routine.State, rea *gen_routine.Error) {
+	var err error
+	if p.C != nil {
+		err = p.C.Close()
+	}
 	if rea.Code == gen_routine.ErrorCodeOk || rea.Code == gen_routine.ErrorGateOffline || rea.Code == gen_routine.ErrorNormalStop {
-		log.Println("terminate by", p.LogId(), "rea", rea.String(), "close", err)
+		log.Println("terminate by", p.LogId(), "state", state, "rea", rea.String(), "close", err)
 	} else {
-		log.Println("terminate by error", p.LogId(), "rea", rea.String(), "close", err)
+		log.Println("terminate by error", p.LogId(), "state", state, "rea", rea.String(), "close", err)
 	}
 }
 
-// HandleMsg 处理协程内收到的消息
-func (p *Player) HandleMsg(msg1 gen_routine.Msg) (interface{}, *gen_routine.Error) {
-	switch v := msg1.(type) {
-	case *msg.Message:
-		p.handleClientMsg(v)
-		return nil, nil
+// 房间成员变化，通知客户端，自己的变化不用通知
+func (p *Player) roomNotify(grp interface{}, who *gen_routine.Svr, action string) {
+	if who == p.Svr || grp != p.chatGrp {
+		return
 	}
-	return nil, nil
+	str := fmt.Sprintf("role %v %s room %d", who.Key(), action, p.chatGrp)
+	p.Resp(constant.MsgGrpChat, constant.MsgCmdNotify, &msg.RspMsgNotify{Msg: str})
 }
 
 func (p *Player) handleClientMsg(v *msg.Message) {
@@ -80,12 +126,13 @@ func (p *Player) handleClientMsg(v *msg.Message) {
 	}
 }
 
+// 消息格式已经由 checkClient 拦截器检查过了
 func (p *Player) handleChatMsg(m *msg.Message) interface{} {
-	switch m.Cmd {
-	case constant.MsgCmdChat:
-		return p.chat(m.Data.(*msg.ReqMsgChat))
-	case constant.MsgCmdJoin:
-		return p.join(m.Data.(*msg.ReqMsgJoin))
+	switch v := m.Data.(type) {
+	case *msg.ReqMsgChat:
+		return p.chat(v)
+	case *msg.ReqMsgJoin:
+		return p.join(v)
 	}
 	return nil
 }
@@ -107,38 +154,153 @@ func (p *Player) chat(m *msg.ReqMsgChat) (ret *msg.RspMsgChat) {
 	if m.Content[0] == '/' {
 		ret.RetStr = p.gm(m.Content)
 	} else {
-		str := profanity.ChangeSensitiveWords(m.Content)
-		rsp := &msg.RspMsgNotify{Msg: str}
-		for _, s := range gen_routine.GrpAll(p.chatGrp) {
-			s.ASyncExec(s.GetMod().(*Player).Resp, uint8(constant.MsgGrpChat), uint8(constant.MsgCmdNotify), rsp)
+		// 扫描敏感词以及广播都在协程池里做，扫描忙不过来直接失败，不卡住玩家
+		// Status 只表示有没有交给扫描协程，不代表已经广播出去了
+		if err := scanPool.TryCast(p.RoleID, &chatScan{roleID: p.RoleID, grp: p.chatGrp, content: m.Content}); err != nil {
+			ret.Status = err.Code
 		}
-		addHistory(p.chatGrp, str)
 	}
 	return
 }
 
+// GM 角色，启动时设置，之后只读
+var gmRoles = map[int64]bool{}
+
+// SetGM 设置 GM 角色，多个用逗号分开，只能在启动时调用
+func SetGM(roles string) {
+	gmRoles = map[int64]bool{}
+	for _, r := range strings.Split(roles, ",") {
+		if role, err := strconv.ParseInt(strings.TrimSpace(r), 10, 64); err == nil {
+			gmRoles[role] = true
+		}
+	}
+}
+
+// 会影响别人或者暴露服务器内部信息的命令只有 GM 能用
+func gmOnly(cmd string) bool {
+	switch cmd {
+	case "/announce", "/sys", "/kick", "/routines":
+		return true
+	}
+	return false
+}
+
 func (p *Player) gm(cmd string) string {
 	str := strings.Split(cmd, " ")
+	if gmOnly(str[0]) && !gmRoles[p.RoleID] {
+		log.Println("gm denied", p.LogId(), "cmd", cmd)
+		return "permission denied"
+	}
 	switch str[0] {
 	case "/stats":
+		return p.stats(str[1:])
+	case "/routines":
+		// 协程运行信息，每个管理器带上邮箱排队最多的3个
+		data, err := gen_routine.DumpTree(3)
+		if err != nil {
+			return err.Error()
+		}
+		return string(data)
+	case "/announce":
+		// 全服公告
+		return p.publish(TopicServer+".announce", strings.Join(str[1:], " "))
+	case "/sys":
+		// 房间系统消息
+		if len(str) < 2 {
+			return "need room"
+		}
+		room, _ := strconv.Atoi(str[1])
+		return p.publish(roomTopic(int32(room))+".system", strings.Join(str[2:], " "))
+	case "/kick":
+		if len(str) < 2 {
+			return "need role"
+		}
 		role, _ := strconv.Atoi(str[1])
 		p1 := GetManager().GetPlayer(int64(role))
-		return fmt.Sprintf("roleid %d grp %d login %d online %d", p1.RoleID, p1.chatGrp, p1.LoginStamp, time.Now().Unix()-p1.LoginStamp)
-	case "/popular":
-		if history.rank == nil {
-			return "no word in"
-		} else {
-			return fmt.Sprintf("word %s times %d", history.rank.word, history.rank.times)
+		if p1 == nil {
+			return "offline"
 		}
+		p1.Kick("kicked by gm " + p.LogId())
+		return "ok"
+	case "/events":
+		return eventStats.String()
+	case "/popular":
+		return popular()
 	default:
 		return "unknown"
 	}
 }
 
+// 查询玩家信息的消息，在玩家自己的协程里处理
+type statsReq struct{}
+
+func (p *Player) statsInfo() string {
+	return fmt.Sprintf("roleid %d state %s grp %d login %d online %d", p.RoleID, p.State(), p.chatGrp, p.LoginStamp, time.Now().Unix()-p.LoginStamp)
+}
+
+// 同时查询多个玩家，最多等 statsTimeout
+func (p *Player) stats(roles []string) string {
+	ret := make([]string, len(roles))
+	futures := make([]*gen_routine.Future, len(roles))
+	for i, r := range roles {
+		role, _ := strconv.Atoi(r)
+		p1 := GetManager().GetPlayer(int64(role))
+		switch {
+		case p1 == nil:
+			ret[i] = fmt.Sprintf("roleid %s offline", r)
+		case p1 == p:
+			// 自己不能等自己
+			ret[i] = p.statsInfo()
+		default:
+			futures[i] = p1.CallAsync(statsReq{})
+		}
+	}
+	var wait []*gen_routine.Future
+	for _, f := range futures {
+		if f != nil {
+			wait = append(wait, f)
+		}
+	}
+	gen_routine.WaitAll(statsTimeout, wait...)
+	for i, f := range futures {
+		if f == nil {
+			continue
+		}
+		// 超时的不再需要了
+		f.Cancel()
+		info, err := f.Await(0)
+		if err != nil {
+			ret[i] = fmt.Sprintf("roleid %s err %s", roles[i], err.String())
+			continue
+		}
+		ret[i], _ = info.(string)
+	}
+	return strings.Join(ret, "\n")
+}
+
+func (p *Player) publish(topic string, content string) string {
+	stats, err := gen_routine.Publish(topic, &msg.RspMsgNotify{Msg: content})
+	if err != nil {
+		return err.String()
+	}
+	return fmt.Sprintf("%s delivered %d dropped %d", topic, stats.Delivered, stats.Dropped)
+}
+
+func roomTopic(grp int32) string {
+	return fmt.Sprintf("%s.%d", TopicRoom, grp)
+}
+
 func (p *Player) join(m *msg.ReqMsgJoin) *msg.RspMsgJoin {
 	p.GrpUnReq(p.chatGrp)
+	p.GrpUnwatch(p.chatGrp)
+	p.Unsubscribe(roomTopic(p.chatGrp) + ".#")
 	p.chatGrp = m.Grp
+	p.GrpWatch(m.Grp)
 	p.GrpReg(m.Grp)
+	if err := p.Subscribe(roomTopic(m.Grp) + ".#"); err != nil {
+		log.Println("subscribe room fail", p.LogId(), "err", err.String())
+	}
+	chatEvents.Notify(&EventJoin{RoleID: p.RoleID, Grp: m.Grp})
 	hMsg := &msg.RspMsgHistory{Msg: getHistory(p.chatGrp)}
 	p.Resp(constant.MsgGrpChat, constant.MsgCmdHistory, hMsg)
 	return &msg.RspMsgJoin{Status: 0}
@@ -150,18 +312,26 @@ func getHistory(grp int32) []string {
 	return history.content[grp]
 }
 
-func addHistory(grp int32, str string) {
+// 排行在事件协程里更新，读也要加锁
+func popular() string {
 	history.Lock()
 	defer history.Unlock()
+	if history.rank == nil {
+		return "no word in"
+	}
+	return fmt.Sprintf("word %s times %d", history.rank.word, history.rank.times)
+}
+
+// 调用者需要持有 history 的锁
+func appendHistory(grp int32, str string) {
 	history.content[grp] = append(history.content[grp], str)
 	l := len(history.content[grp])
 	if l > 50 {
 		history.content[grp] = history.content[grp][l-50:]
 	}
-	// 词频记录
-	updateFrequency(str)
 }
 
+// 调用者需要持有 history 的锁
 func updateFrequency(str string) {
 	// 词频记录
 	str = strings.ReplaceAll(str, "*", "")
@@ -4,11 +4,12 @@ import (
 	"github.com/huhu401/chat_test/constant"
 	"github.com/huhu401/chat_test/gen_routine"
 	"github.com/huhu401/chat_test/msg"
+	"log"
 	"sync"
 )
 
 type Mgr struct {
-	*gen_routine.Mgr
+	*gen_routine.TypedMgr[int64, *Player]
 	sync.Mutex
 }
 
@@ -41,15 +42,36 @@ func BeforeMain() {
 		Mutex:     sync.Mutex{},
 		frequency: map[string]*TimesElem{},
 	}
+	// 聊天记录、排行都挂在事件上，起不来直接退出
+	if err := startEvents(); err != nil {
+		log.Fatalln("start chat events fail", err.String())
+	}
+	// 没有扫描协程池发不了言，起不来直接退出
+	if err := startScanPool(); err != nil {
+		log.Fatalln("start profanity pool fail", err.String())
+	}
+	gen_routine.SetDeadLetterHandler(deadLetter)
+}
+
+// 发给已经下线玩家的消息
+// 房间广播和刚下线的玩家赛跑是正常的，只计数，其他的打日志
+func deadLetter(dl *gen_routine.DeadLetter) {
+	switch dl.Msg.(type) {
+	case *msg.RspMsgNotify, *gen_routine.MsgPub, *gen_routine.GroupJoined, *gen_routine.GroupLeft:
+		return
+	}
+	log.Printf("dead letter to role %v msg %T", dl.Svr.Key(), dl.Msg)
 }
 
 func newManager() (*gen_routine.Mgr, *gen_routine.Error) {
-	mgr, err := gen_routine.NewMgr(gen_routine.RootMgr(), "player rMgr")
-	playerMgr = &Mgr{Mgr: mgr}
+	mgr, err := gen_routine.NewTypedMgr[int64, *Player](gen_routine.RootMgr(), "player rMgr")
+	playerMgr = &Mgr{TypedMgr: mgr}
 	if err != nil {
 		return nil, err
 	}
-	return mgr, nil
+	// 日志、崩溃、消息检查这些每个玩家都要做的放到拦截器里
+	mgr.Use(playerInterceptors()...)
+	return mgr.Mgr, nil
 }
 
 // GetManager 获取全局玩家manager
@@ -59,27 +81,26 @@ func GetManager() *Mgr {
 
 // GetPlayer 获取玩家
 func (mgr *Mgr) GetPlayer(roleId int64) *Player {
-	v, ok := mgr.LookupSvr(roleId)
+	p, ok := mgr.Lookup(roleId)
 	if !ok {
 		return nil
 	}
-	svr := v.(*gen_routine.Svr)
-	return svr.GetMod().(*Player)
+	return p
 }
 
 // Login 玩家登陆
 func (mgr *Mgr) Login(req *msg.ReqMsgLogin) *Player {
 	rsp := &msg.RspMsgLogin{Status: constant.ErrorNo}
 	p := NewPlayer(req)
-	old, err := mgr.NewSvr(p.Key(), p)
+	old, err := mgr.NewSvr(p.RoleID, p, gen_routine.WithIdleTimeout(IdleTimeout), gen_routine.WithIdleFilter(clientActive))
 	if err != nil && err.Code != gen_routine.ErrorAlreadyHad {
 		rsp.Status = err.Code
 	} else {
 		if err != nil && err.Code == gen_routine.ErrorAlreadyHad {
-			old.GetMod().(*Player).alreadyIn(req)
+			old.alreadyIn(req)
 		}
 	}
-	return old.GetMod().(*Player)
+	return old
 }
 
 func (mgr *Mgr) Logout(roleId int64) {
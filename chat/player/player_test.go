@@ -0,0 +1,111 @@
+package player
+
+import (
+	"github.com/huhu401/chat_test/constant"
+	"github.com/huhu401/chat_test/gen_routine"
+	"github.com/huhu401/chat_test/msg"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPlayer_GM(t *testing.T) {
+	SetGM("1, 2")
+	defer SetGM("")
+	p := &Player{RoleID: 3}
+	// 不是 GM 的玩家用不了
+	for _, cmd := range []string{"/routines", "/announce hi", "/sys 1 hi", "/kick 1"} {
+		assert.Equal(t, "permission denied", p.gm(cmd), cmd)
+	}
+
+	// GM 可以看协程信息
+	gm := &Player{RoleID: 2}
+	assert.Contains(t, gm.gm("/routines"), "global")
+}
+
+func initPlayerMgr(t *testing.T) {
+	gen_routine.BeforeMain()
+	BeforeMain()
+	t.Cleanup(func() {
+		gen_routine.RootMgr().StopMgr(&gen_routine.Error{Code: gen_routine.ErrorNormalStop}, gen_routine.WithDeadline(time.Second))
+	})
+}
+
+// 协程里查玩家当前的状态
+func stateOf(t *testing.T, p *Player) gen_routine.State {
+	state, err := gen_routine.CallFn(p.Svr, func(p *Player) gen_routine.State { return p.State() }, time.Second)
+	assert.Nil(t, err)
+	return state
+}
+
+// 客户端那边收到的消息，连接关了则 chan 关闭
+func readClient(c net.Conn) chan *msg.Message {
+	out := make(chan *msg.Message, 16)
+	go func() {
+		defer close(out)
+		for {
+			m, err := msg.Read(c, false)
+			if err != nil {
+				return
+			}
+			out <- m
+		}
+	}()
+	return out
+}
+
+func waitOffline(t *testing.T, role int64) {
+	for i := 0; i < 300; i++ {
+		if GetManager().GetPlayer(role) == nil {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("role %d still online", role)
+}
+
+func TestPlayer_Login(t *testing.T) {
+	initPlayerMgr(t)
+	p := GetManager().Login(&msg.ReqMsgLogin{RoleId: 10})
+	assert.NotNil(t, p)
+	assert.Equal(t, StateConnecting, stateOf(t, p))
+
+	// 连接交过来之前的消息推迟到登陆以后处理
+	p.Cast(&msg.Message{Grp: constant.MsgGrpChat, Cmd: constant.MsgCmdJoin, Data: &msg.ReqMsgJoin{Grp: 5}})
+	assert.Equal(t, StateConnecting, stateOf(t, p))
+
+	server, client := net.Pipe()
+	recv := readClient(client)
+	p.Connect(server)
+	m := <-recv
+	assert.Equal(t, uint8(constant.MsgCmdLogin), m.Cmd)
+	assert.Equal(t, int32(0), m.Data.(*msg.RspMsgLogin).Status)
+	m = <-recv
+	assert.Equal(t, uint8(constant.MsgCmdHistory), m.Cmd)
+	m = <-recv
+	assert.Equal(t, uint8(constant.MsgCmdJoin), m.Cmd)
+	assert.Equal(t, StateInRoom, stateOf(t, p))
+
+	// 踢下线，先收到通知，过一会连接关掉
+	p.Kick("test")
+	assert.Equal(t, StateKicked, stateOf(t, p))
+	m = <-recv
+	assert.Equal(t, "you are kicked", m.Data.(*msg.RspMsgNotify).Msg)
+	for range recv {
+	}
+	waitOffline(t, 10)
+}
+
+func TestPlayer_ConnectTimeout(t *testing.T) {
+	initPlayerMgr(t)
+	old := connectTimeout
+	connectTimeout = time.Millisecond * 50
+	defer func() {
+		connectTimeout = old
+	}()
+	// 登陆了一直没有连接交过来，超时退出
+	p := GetManager().Login(&msg.ReqMsgLogin{RoleId: 11})
+	assert.NotNil(t, p)
+	waitOffline(t, 11)
+}
@@ -0,0 +1,56 @@
+package player
+
+import (
+	"github.com/huhu401/chat_test/gen_routine"
+	"github.com/huhu401/chat_test/msg"
+	"github.com/huhu401/chat_test/profanity"
+	"log"
+	"runtime"
+)
+
+// 敏感词扫描比较耗 cpu，放到协程池里做，不占玩家协程
+// 按玩家分派，同一个玩家的发言顺序不变
+
+// 待扫描的发言
+type chatScan struct {
+	roleID  int64
+	grp     int32
+	content string
+}
+
+type scanWorker struct{}
+
+var scanPool *gen_routine.Pool
+
+func startScanPool() *gen_routine.Error {
+	pool, err := gen_routine.NewPool(gen_routine.RootMgr(), "profanity pool", runtime.NumCPU(),
+		func() gen_routine.SvrBehavior { return &scanWorker{} }, gen_routine.WithDispatch(gen_routine.DispatchHash))
+	scanPool = pool
+	return err
+}
+
+func (w *scanWorker) Init(*gen_routine.Svr) *gen_routine.Error {
+	return nil
+}
+
+func (w *scanWorker) Terminate(reason *gen_routine.Error) {
+}
+
+// HandleMsg 屏蔽敏感词后广播给房间
+func (w *scanWorker) HandleMsg(m gen_routine.Msg) (interface{}, *gen_routine.Error) {
+	v, ok := m.(*chatScan)
+	if !ok {
+		return nil, nil
+	}
+	str := profanity.ChangeSensitiveWords(v.content)
+	if str != v.content {
+		chatEvents.Notify(&EventModeration{RoleID: v.roleID, Grp: v.grp, Original: v.content, Filtered: str})
+	}
+	// 邮箱满了的玩家直接丢掉，不卡住扫描
+	stats := gen_routine.GrpCast(v.grp, &msg.RspMsgNotify{Msg: str})
+	if stats.Dropped > 0 {
+		log.Println("chat notify dropped", v.roleID, "grp", v.grp, "stats", stats)
+	}
+	chatEvents.Notify(&EventChat{RoleID: v.roleID, Grp: v.grp, Content: str})
+	return nil, nil
+}
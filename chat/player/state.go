@@ -0,0 +1,127 @@
+package player
+
+import (
+	"github.com/huhu401/chat_test/constant"
+	"github.com/huhu401/chat_test/gen_routine"
+	"github.com/huhu401/chat_test/msg"
+	"log"
+	"net"
+	"time"
+)
+
+// 玩家状态
+const (
+	StateConnecting    gen_routine.State = "connecting"    // 协程起来了，还在等连接
+	StateAuthenticated gen_routine.State = "authenticated" // 登陆成功，还没进房间
+	StateInRoom        gen_routine.State = "in-room"       // 在聊天室里
+	StateKicked        gen_routine.State = "kicked"        // 被踢了，等一会再退出
+)
+
+// 登陆后多久还没有连接交过来则退出，测试里会改短
+var connectTimeout = time.Second * 10
+
+// 踢下线后留给客户端收通知的时间
+const kickGrace = time.Second
+
+// 连接交给玩家协程
+type connect struct {
+	c net.Conn
+}
+
+// 踢下线
+type kick struct {
+	reason string
+}
+
+// States 玩家的所有状态
+func (p *Player) States() map[gen_routine.State]*gen_routine.StateSpec {
+	return map[gen_routine.State]*gen_routine.StateSpec{
+		StateConnecting: {
+			Handle:  p.handleConnecting,
+			Timeout: connectTimeout,
+		},
+		StateAuthenticated: {
+			Handle: p.handleOnline,
+		},
+		StateInRoom: {
+			Handle: p.handleOnline,
+		},
+		StateKicked: {
+			Enter:   p.enterKicked,
+			Handle:  p.handleKicked,
+			Timeout: kickGrace,
+		},
+	}
+}
+
+// 还没有连接，别的消息都推迟到连上以后
+func (p *Player) handleConnecting(m gen_routine.Msg) (interface{}, gen_routine.State, *gen_routine.Error) {
+	switch v := m.(type) {
+	case *connect:
+		p.C = v.c
+		p.Resp(constant.MsgGrpLogin, constant.MsgCmdLogin, &msg.RspMsgLogin{Status: 0})
+		chatEvents.Notify(&EventLogin{RoleID: p.RoleID})
+		return nil, StateAuthenticated, nil
+	case *gen_routine.StateTimeout:
+		return nil, "", &gen_routine.Error{Code: gen_routine.ErrorNormalStop, Param: "connect timeout"}
+	case *kick:
+		return nil, StateKicked, nil
+	case statsReq:
+		return p.statsInfo(), "", nil
+	}
+	return gen_routine.Postpone, "", nil
+}
+
+// 在线，进没进房间都在这里处理
+func (p *Player) handleOnline(m gen_routine.Msg) (interface{}, gen_routine.State, *gen_routine.Error) {
+	switch v := m.(type) {
+	case *connect:
+		// 顶号，换成新的连接
+		if p.C != nil {
+			p.C.Close()
+		}
+		p.C = v.c
+		p.Resp(constant.MsgGrpLogin, constant.MsgCmdLogin, &msg.RspMsgLogin{Status: 0})
+	case *msg.Message:
+		p.handleClientMsg(v)
+		if v.Grp == constant.MsgGrpChat && v.Cmd == constant.MsgCmdJoin {
+			return nil, StateInRoom, nil
+		}
+	case *msg.RspMsgNotify:
+		p.Resp(constant.MsgGrpChat, constant.MsgCmdNotify, v)
+	case statsReq:
+		return p.statsInfo(), "", nil
+	case *gen_routine.MsgPub:
+		if n, ok := v.Msg.(*msg.RspMsgNotify); ok {
+			p.Resp(constant.MsgGrpChat, constant.MsgCmdNotify, n)
+		}
+	case *gen_routine.GroupJoined:
+		p.roomNotify(v.Key, v.Svr, "joined")
+	case *gen_routine.GroupLeft:
+		p.roomNotify(v.Key, v.Svr, "left")
+	case *kick:
+		log.Println("player kicked", p.LogId(), "reason", v.reason)
+		return nil, StateKicked, nil
+	}
+	return nil, "", nil
+}
+
+// 通知客户端，离开房间以及所有订阅，等客户端收到通知再退出
+func (p *Player) enterKicked(from gen_routine.State) *gen_routine.Error {
+	if p.C != nil {
+		p.Resp(constant.MsgGrpChat, constant.MsgCmdNotify, &msg.RspMsgNotify{Msg: "you are kicked"})
+	}
+	p.GrpByeBye()
+	return nil
+}
+
+func (p *Player) handleKicked(m gen_routine.Msg) (interface{}, gen_routine.State, *gen_routine.Error) {
+	switch m.(type) {
+	case *gen_routine.StateTimeout:
+		return nil, "", &gen_routine.Error{Code: gen_routine.ErrorNormalStop, Param: "kicked"}
+	case statsReq:
+		return p.statsInfo(), "", nil
+	}
+	// 已经踢了，别的都不处理
+	return nil, "", nil
+}
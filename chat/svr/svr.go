@@ -52,8 +52,7 @@ func svr(c net.Conn) {
 		}
 		if m.Grp == constant.MsgGrpLogin && m.Cmd == constant.MsgCmdLogin {
 			p = player.GetManager().Login(m.Data.(*msg.ReqMsgLogin))
-			p.C = c
-			p.ASyncExec(p.Resp, uint8(constant.MsgGrpLogin), uint8(constant.MsgCmdLogin), &msg.RspMsgLogin{Status: 0})
+			p.Connect(c)
 		} else {
 			if p != nil {
 				p.Cast(m)
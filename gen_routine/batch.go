@@ -0,0 +1,92 @@
+package gen_routine
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// 可以放进批量处理的消息，框架自己的消息还是一条一条处理
+func batchable(msg Msg) bool {
+	switch msg.(type) {
+	case *MsgCall, *MsgStop, *MsgExec, *MsgFn:
+		return false
+	}
+	return true
+}
+
+// 处理邮箱里的消息，能批量的顺带把后面排队的普通消息一起处理
+func (svr *Svr) processMailbox(mod BatchBehavior, msg Msg) *Error {
+	svr.touch(msg)
+	if mod == nil || !batchable(msg) {
+		return svr.process(msg)
+	}
+	msgs, next := svr.collectBatch(msg)
+	for _, m := range msgs[1:] {
+		svr.touch(m)
+	}
+	if next != nil {
+		svr.touch(next)
+	}
+	if err := svr.processBatch(mod, msgs); err != nil {
+		return err
+	}
+	if next != nil {
+		return svr.process(next)
+	}
+	return nil
+}
+
+// 从邮箱里再拿排队的普通消息，碰到不能批量的消息返回它，交给调用者接着处理
+func (svr *Svr) collectBatch(first Msg) (msgs []Msg, next Msg) {
+	msgs = []Msg{first}
+	for len(msgs) < svr.opts.batch {
+		// 有控制消息就先停下来，让它先处理
+		if len(svr.sysC) > 0 {
+			return msgs, nil
+		}
+		select {
+		case msg := <-svr.receive:
+			if !batchable(msg) {
+				return msgs, msg
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs, nil
+		}
+	}
+	return msgs, nil
+}
+
+func (svr *Svr) processBatch(mod BatchBehavior, msgs []Msg) *Error {
+	atomic.StoreInt32(&svr.busy, 1)
+	start := time.Now()
+	err := svr.handleBatch(mod, msgs)
+	// 耗时平摊到每条消息上，崩溃只算一次
+	d := time.Since(start) / time.Duration(len(msgs))
+	for i, msg := range msgs {
+		if i == len(msgs)-1 {
+			svr.record(msg, d, err)
+		} else {
+			svr.record(msg, d, nil)
+		}
+	}
+	if err != nil && err.Code != ErrorCodeOk {
+		return err
+	}
+	return nil
+}
+
+func (svr *Svr) handleBatch(mod BatchBehavior, msgs []Msg) (reason *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			reason = &Error{Code: ErrorCrash, ParamPanic: r, Param: string(debug.Stack())}
+			svr.mgr.rt.errorf("svr handle batch crash %v \n%s", reason.ParamPanic, reason.Param)
+		}
+	}()
+	msgs, reason = svr.interceptBatch(msgs)
+	if reason != nil || len(msgs) == 0 {
+		return
+	}
+	return mod.HandleBatch(msgs)
+}
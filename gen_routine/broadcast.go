@@ -0,0 +1,89 @@
+package gen_routine
+
+import (
+	"context"
+	"time"
+)
+
+// castOpts 分组广播参数
+type castOpts struct {
+	overflow Overflow
+	timeout  time.Duration
+	exclude  *Svr
+}
+
+// CastOption 分组广播参数设置
+type CastOption func(o *castOpts)
+
+// WithCastOverflow 设置成员邮箱满了的策略，默认 OverflowDropNewest 不等待
+// OverflowBlock 以及 OverflowBlockTimeout 最多等 timeout，timeout 为0 则一直等到成员退出
+func WithCastOverflow(policy Overflow, timeout time.Duration) CastOption {
+	return func(o *castOpts) {
+		o.overflow = policy
+		o.timeout = timeout
+	}
+}
+
+// WithExclude 广播时跳过某个协程，一般是自己
+func WithExclude(svr *Svr) CastOption {
+	return func(o *castOpts) {
+		o.exclude = svr
+	}
+}
+
+// CastStats 分组广播结果
+type CastStats struct {
+	Delivered int // 投递成功
+	Dropped   int // 邮箱满了或者等待超时，丢掉了
+	Dead      int // 协程已经退出了
+}
+
+func newCastOpts(opts []CastOption) castOpts {
+	o := castOpts{overflow: OverflowDropNewest}
+	for _, f := range opts {
+		f(&o)
+	}
+	return o
+}
+
+// 给分组里所有协程投递消息，一个成员卡住不会影响其他成员
+func (grp *group) cast(key interface{}, msg Msg, opts []CastOption) CastStats {
+	return castTo(grp.snapshot(key), msg, newCastOpts(opts))
+}
+
+// 给一批协程投递消息
+func castTo(svrs []*Svr, msg Msg, o castOpts) CastStats {
+	var stats CastStats
+	for _, svr := range svrs {
+		if svr == o.exclude {
+			continue
+		}
+		var err *Error
+		switch o.overflow {
+		case OverflowBlock, OverflowBlockTimeout:
+			ctx := context.Background()
+			if o.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, o.timeout)
+				err = svr.push(ctx, msg, OverflowBlock)
+				cancel()
+			} else {
+				err = svr.push(ctx, msg, OverflowBlock)
+			}
+		case OverflowDropNewest:
+			// 需要知道有没有丢，按返回错误的方式投递
+			err = svr.push(context.Background(), msg, OverflowError)
+		default:
+			err = svr.push(context.Background(), msg, o.overflow)
+		}
+		switch {
+		case err == nil:
+			stats.Delivered++
+		case err.Code == ErrorClosed:
+			stats.Dead++
+		default:
+			stats.Dropped++
+		}
+	}
+	return stats
+}
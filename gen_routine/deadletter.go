@@ -0,0 +1,61 @@
+package gen_routine
+
+import "sync/atomic"
+
+// 死信处理放在 atomic.Value 里，设置和读取不用加锁
+type deadHandler struct {
+	h DeadLetterHandler
+}
+
+// DeadLetter 发给已经退出的协程的消息，以及退出时邮箱里还没处理的消息
+type DeadLetter struct {
+	Svr *Svr
+	Msg Msg
+}
+
+// DeadLetterHandler 死信处理，在发送者的协程里调用，不要阻塞
+type DeadLetterHandler func(dl *DeadLetter)
+
+// 记录一封死信
+func (rt *Runtime) deadLetter(svr *Svr, msg Msg) {
+	switch v := msg.(type) {
+	case *MsgStop:
+		// 关一个已经退出的协程不算
+		return
+	case *MsgCall:
+		// 调用者那边会收到 ErrorClosed
+		msg = v.msg
+	}
+	atomic.AddUint64(&rt.deadLetters, 1)
+	if v, _ := rt.deadHandler.Load().(deadHandler); v.h != nil {
+		v.h(&DeadLetter{Svr: svr, Msg: msg})
+		return
+	}
+	rt.errorf("dead letter to %s/%v msg %T", svr.mgr.name, svr.key, msg)
+}
+
+// 协程退出后，控制通道以及邮箱里剩下的都转成死信
+// 调用前 done 已经关了，控制通道标记关闭后不会再有新的，邮箱由 push 自己再检查
+func (svr *Svr) drainDead() {
+	svr.sysMux.Lock()
+	sys := svr.sysQ
+	svr.sysQ = nil
+	svr.sysClosed = true
+	svr.sysMux.Unlock()
+	for _, msg := range sys {
+		svr.mgr.rt.deadLetter(svr, msg)
+	}
+	svr.drainMailbox()
+}
+
+// 邮箱里剩下的转成死信，可以多个协程同时调
+func (svr *Svr) drainMailbox() {
+	for {
+		select {
+		case msg := <-svr.receive:
+			svr.mgr.rt.deadLetter(svr, msg)
+		default:
+			return
+		}
+	}
+}
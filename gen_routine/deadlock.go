@@ -0,0 +1,79 @@
+package gen_routine
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 调用等了这么久还没返回，才去检查是否形成了环
+const deadlockCheckDelay = time.Millisecond
+
+// callGraph 记录哪个协程正卡在 call 谁，用来检测死锁
+type callGraph struct {
+	svrOfG  sync.Map // 协程编号 -> *Svr
+	mux     sync.Mutex
+	waiting map[*Svr]*Svr // 调用者 -> 被调用者
+}
+
+func newCallGraph() *callGraph {
+	return &callGraph{waiting: map[*Svr]*Svr{}}
+}
+
+// 协程 loop 开始时绑定协程编号
+func (g *callGraph) bind(gid uint64, svr *Svr) {
+	g.svrOfG.Store(gid, svr)
+}
+
+func (g *callGraph) unbind(gid uint64) {
+	g.svrOfG.Delete(gid)
+}
+
+// 当前在哪个 svr 的协程里，不在任何 svr 里返回 nil
+func (g *callGraph) current() *Svr {
+	v, ok := g.svrOfG.Load(goroutineID())
+	if !ok {
+		return nil
+	}
+	return v.(*Svr)
+}
+
+// 记录 caller 开始等 target，形成环则返回 ErrorDeadlock
+func (g *callGraph) enter(caller *Svr, target *Svr) *Error {
+	g.mux.Lock()
+	defer func() {
+		g.mux.Unlock()
+	}()
+	chain := []*Svr{caller, target}
+	for next := target; next != caller; {
+		next = g.waiting[next]
+		if next == nil {
+			g.waiting[caller] = target
+			return nil
+		}
+		chain = append(chain, next)
+		// 环里没有 caller 的情况，不是这次调用造成的
+		if len(chain) > len(g.waiting)+2 {
+			g.waiting[caller] = target
+			return nil
+		}
+	}
+	return &Error{Code: ErrorDeadlock, Param: "call chain : " + callChain(chain)}
+}
+
+func (g *callGraph) leave(caller *Svr) {
+	g.mux.Lock()
+	defer func() {
+		g.mux.Unlock()
+	}()
+	delete(g.waiting, caller)
+}
+
+func callChain(chain []*Svr) string {
+	a := make([]string, len(chain))
+	for i, svr := range chain {
+		a[i] = fmt.Sprintf("%s/%v", svr.mgr.name, svr.key)
+	}
+	return strings.Join(a, " -> ")
+}
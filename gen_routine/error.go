@@ -2,7 +2,6 @@ package gen_routine
 
 import (
 	"fmt"
-	"log"
 )
 
 type Error struct {
@@ -12,14 +11,9 @@ type Error struct {
 	Last       *Error
 }
 
-var logger Logger
-
+// errorf 默认运行环境的日志输出
 func errorf(fmt string, args ...interface{}) {
-	if logger != nil {
-		logger.Errorf(fmt, args...)
-		return
-	}
-	log.Printf(fmt, args...)
+	defaultRT.errorf(fmt, args...)
 }
 
 func (e *Error) String() string {
@@ -39,17 +33,30 @@ func (e *Error) String() string {
 }
 
 const (
-	ErrorCodeOk           = int32(0) - iota
-	ErrorNotFind          = int32(-1)
-	ErrorCtxDone          = int32(-2)
-	ErrorCrash            = int32(-3)
-	ErrorNormalStop       = int32(-4)
-	ErrorTimeout          = int32(-5)
-	ErrorClosed           = int32(-6)
-	ErrorAlreadyHad       = int32(-7)
-	ErrorGateOffline      = int32(-8)
-	ErrorReflectParamsLen = int32(-9)  // 反射调用函数时，参数长度不足
-	ErrorRoutineInitFail  = int32(-10) // 协程初始化失败
-	ErrorPbUnmarshal      = int32(-11) // Protocol buff 反序列化失败
-	ErrorRpc              = int32(-12) // rpc 调用过程中出错了
+	ErrorCodeOk            = int32(0) - iota
+	ErrorNotFind           = int32(-1)
+	ErrorCtxDone           = int32(-2)
+	ErrorCrash             = int32(-3)
+	ErrorNormalStop        = int32(-4)
+	ErrorTimeout           = int32(-5)
+	ErrorClosed            = int32(-6)
+	ErrorAlreadyHad        = int32(-7)
+	ErrorGateOffline       = int32(-8)
+	ErrorReflectParamsLen  = int32(-9)  // 反射调用函数时，参数长度不足
+	ErrorRoutineInitFail   = int32(-10) // 协程初始化失败
+	ErrorPbUnmarshal       = int32(-11) // Protocol buff 反序列化失败
+	ErrorRpc               = int32(-12) // rpc 调用过程中出错了
+	ErrorNotSupervisor     = int32(-13) // 管理器不是监督者
+	ErrorShutdown          = int32(-14) // 被监督者关闭
+	ErrorRestartLimit      = int32(-15) // 重启太频繁，监督者退出
+	ErrorLinkExit          = int32(-16) // 链接的协程非正常退出，被一起带走
+	ErrorMailboxFull       = int32(-17) // 协程邮箱满了
+	ErrorReflectParamsType = int32(-18) // 反射调用函数时，参数类型不对
+	ErrorModType           = int32(-19) // 协程逻辑模块类型不对
+	ErrorDeadlock          = int32(-20) // 调用会形成死锁，比如自己调自己
+	ErrorTopic             = int32(-21) // 主题格式不对
+	ErrorStateUnknown      = int32(-22) // 状态机切换到没有定义的状态
+	ErrorTask              = int32(-23) // 任务返回了错误
+	ErrorRejected          = int32(-24) // 消息被拦截器拒绝
+	ErrorPoolDispatch      = int32(-25) // 协程池的分派方式不支持这个操作
 )
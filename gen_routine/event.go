@@ -0,0 +1,163 @@
+package gen_routine
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// EventHandler 事件处理，挂在事件管理器上，收到所有通知的事件
+// 在事件管理器的协程里调用，返回错误或者崩溃则把它从事件管理器里删掉
+type EventHandler interface {
+	HandleEvent(event Msg) *Error
+}
+
+// BatchEventHandler 可选接口，事件管理器设置了 WithBatch 时一次处理多个事件
+type BatchEventHandler interface {
+	HandleEvents(events []Msg) *Error
+}
+
+// EventTerminator 可选接口，处理被删掉时回调，reason 为nil 表示主动删掉
+type EventTerminator interface {
+	TerminateHandler(reason *Error)
+}
+
+// EventMgr 事件管理器，可以在运行时加减事件处理
+type EventMgr struct {
+	svr *Svr
+}
+
+type eventHandler struct {
+	id interface{}
+	h  EventHandler
+}
+
+// 事件管理器协程的逻辑模块
+type eventBehavior struct {
+	svr      *Svr
+	handlers []*eventHandler // 按加入的顺序
+}
+
+// 新建事件管理器
+func newEventMgr(mgr *Mgr, k interface{}, opts []SvrOption) (*EventMgr, *Error) {
+	svr, err := mgr.newSvr(k, &eventBehavior{}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &EventMgr{svr: svr}, nil
+}
+
+func (eb *eventBehavior) Init(svr *Svr) *Error {
+	eb.svr = svr
+	return nil
+}
+
+func (eb *eventBehavior) HandleMsg(msg Msg) (interface{}, *Error) {
+	eb.notify([]Msg{msg})
+	return nil, nil
+}
+
+// HandleBatch 实现 BatchBehavior
+func (eb *eventBehavior) HandleBatch(msgs []Msg) *Error {
+	eb.notify(msgs)
+	return nil
+}
+
+// 事件管理器退出，所有处理都删掉
+func (eb *eventBehavior) Terminate(reason *Error) {
+	handlers := eb.handlers
+	eb.handlers = nil
+	for _, h := range handlers {
+		eb.terminate(h, reason)
+	}
+}
+
+func (eb *eventBehavior) index(id interface{}) int {
+	for i, h := range eb.handlers {
+		if h.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (eb *eventBehavior) add(id interface{}, h EventHandler) *Error {
+	if eb.index(id) >= 0 {
+		return &Error{Code: ErrorAlreadyHad}
+	}
+	eb.handlers = append(eb.handlers, &eventHandler{id: id, h: h})
+	return nil
+}
+
+func (eb *eventBehavior) remove(id interface{}, reason *Error) *Error {
+	idx := eb.index(id)
+	if idx < 0 {
+		return &Error{Code: ErrorNotFind}
+	}
+	h := eb.handlers[idx]
+	eb.handlers = append(eb.handlers[:idx], eb.handlers[idx+1:]...)
+	eb.terminate(h, reason)
+	return nil
+}
+
+func (eb *eventBehavior) ids() []interface{} {
+	ids := make([]interface{}, 0, len(eb.handlers))
+	for _, h := range eb.handlers {
+		ids = append(ids, h.id)
+	}
+	return ids
+}
+
+// 事件按顺序交给每个处理，出错的删掉，不影响其他的
+func (eb *eventBehavior) notify(events []Msg) {
+	var failed []*eventHandler
+	var reasons []*Error
+	for _, h := range eb.handlers {
+		if err := eb.call(h, events); err != nil {
+			failed = append(failed, h)
+			reasons = append(reasons, err)
+		}
+	}
+	for i, h := range failed {
+		eb.svr.mgr.rt.errorf("event handler %v removed from %v reason %s", h.id, eb.svr.key, reasons[i].String())
+		eb.remove(h.id, reasons[i])
+	}
+}
+
+func (eb *eventBehavior) call(h *eventHandler, events []Msg) (reason *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			reason = &Error{Code: ErrorCrash, ParamPanic: r, Param: string(debug.Stack())}
+		}
+	}()
+	if b, ok := h.h.(BatchEventHandler); ok && len(events) > 1 {
+		return b.HandleEvents(events)
+	}
+	for _, event := range events {
+		if err := h.h.HandleEvent(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (eb *eventBehavior) terminate(h *eventHandler, reason *Error) {
+	t, ok := h.h.(EventTerminator)
+	if !ok {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			eb.svr.mgr.rt.errorf("event handler %v terminate crash %v \n%s", h.id, r, string(debug.Stack()))
+		}
+	}()
+	t.TerminateHandler(reason)
+}
+
+// 在事件管理器协程里执行
+func (em *EventMgr) exec(f func(eb *eventBehavior) *Error, timeout time.Duration) *Error {
+	ret, err := CallFn(em.svr, f, timeout)
+	if err != nil {
+		return err
+	}
+	return ret
+}
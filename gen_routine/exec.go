@@ -0,0 +1,87 @@
+package gen_routine
+
+import "fmt"
+
+// MsgFn 类型安全的函数调用，不走反射
+type MsgFn struct {
+	f      func(mod SvrBehavior) interface{}
+	isSync bool // 是否为阻塞调用
+}
+
+// handleFn 处理直接走协程调用闭包的情况
+func (svr *Svr) handleFn(msg *MsgFn) (interface{}, *Error) {
+	ret := msg.f(svr.mod)
+	if !msg.isSync {
+		return nil, nil
+	}
+	return ret, nil
+}
+
+// 检查协程的逻辑模块类型
+func modOf[B SvrBehavior](svr *Svr) *Error {
+	if _, ok := svr.mod.(B); !ok {
+		var b B
+		return &Error{Code: ErrorModType, Param: fmt.Sprintf("expected : %T, actual : %T", b, svr.mod)}
+	}
+	return nil
+}
+
+// TypedMgr 带类型的管理器，key 类型为 K，协程逻辑模块类型为 B
+type TypedMgr[K comparable, B SvrBehavior] struct {
+	*Mgr
+}
+
+// NewTypedMgr 开一个带类型的管理器
+func NewTypedMgr[K comparable, B SvrBehavior](parent *Mgr, name string) (*TypedMgr[K, B], *Error) {
+	mgr, err := newMgr(parent, name)
+	return &TypedMgr[K, B]{Mgr: mgr}, err
+}
+
+// NewSvr 开个协程，已经有了则返回老的逻辑模块以及 ErrorAlreadyHad
+func (mgr *TypedMgr[K, B]) NewSvr(k K, mod B, opts ...SvrOption) (B, *Error) {
+	var b B
+	svr, err := mgr.newSvr(k, mod, opts...)
+	if svr == nil {
+		return b, err
+	}
+	// 老的可能是通过里面的 *Mgr 开的别的类型
+	b, ok := svr.mod.(B)
+	if !ok {
+		return b, &Error{Code: ErrorModType, Param: fmt.Sprintf("%T", svr.mod), Last: err}
+	}
+	return b, err
+}
+
+// Lookup 查询协程的逻辑模块
+func (mgr *TypedMgr[K, B]) Lookup(k K) (B, bool) {
+	var b B
+	v, ok := mgr.lookup(k)
+	if !ok {
+		return b, false
+	}
+	svr, ok := v.(*Svr)
+	if !ok {
+		return b, false
+	}
+	b, ok = svr.mod.(B)
+	return b, ok
+}
+
+// Foreach 遍历协程的逻辑模块，类型对不上的跳过
+func (mgr *TypedMgr[K, B]) Foreach(f func(k K, mod B) bool) {
+	mgr.foreach(func(k interface{}, v interface{}) bool {
+		svr, ok := v.(*Svr)
+		if !ok {
+			return true
+		}
+		key, ok := k.(K)
+		if !ok {
+			return true
+		}
+		mod, ok := svr.mod.(B)
+		if !ok {
+			return true
+		}
+		return f(key, mod)
+	})
+}
@@ -0,0 +1,123 @@
+package gen_routine
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Future 异步调用的结果
+// 不需要另起协程等待，放弃了也不会泄漏，处理方回复后就可以回收
+type Future struct {
+	svr    *Svr
+	call   *MsgCall
+	cancel context.CancelFunc
+	once   sync.Once
+	done   chan struct{}
+	res    *MsgRet
+}
+
+// 发起异步调用
+func (svr *Svr) callAsync(msg Msg) *Future {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Future{svr: svr, cancel: cancel, done: make(chan struct{})}
+	f.call = &MsgCall{msg: msg, ctx: ctx, fut: f}
+	// 异步调用不能卡住调用者，邮箱满了直接失败
+	if err := svr.push(ctx, f.call, OverflowError); err != nil {
+		f.resolve(&MsgRet{err: err})
+	}
+	return f
+}
+
+// 设置结果，只有第一次有效
+func (f *Future) resolve(ret *MsgRet) bool {
+	ok := false
+	f.once.Do(func() {
+		f.res = ret
+		close(f.done)
+		f.cancel()
+		ok = true
+	})
+	return ok
+}
+
+func (f *Future) result() (interface{}, *Error) {
+	return f.res.ret, f.res.err
+}
+
+// 目标已经退出了，还没有结果的算关闭
+func (f *Future) svrExit() {
+	f.resolve(&MsgRet{err: &Error{Code: ErrorClosed}})
+}
+
+func (f *Future) await(timeout time.Duration) (interface{}, *Error) {
+	select {
+	case <-f.done:
+		return f.result()
+	default:
+	}
+	// 在目标协程里等自己的结果，永远等不到
+	if atomic.LoadInt32(&f.svr.busy) == 1 && f.svr.mgr.rt.calls.current() == f.svr {
+		return nil, &Error{Code: ErrorDeadlock, Param: "call chain : " + callChain([]*Svr{f.svr, f.svr})}
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-f.done:
+	case <-f.svr.done:
+		f.svrExit()
+	case <-t.C:
+		return nil, &Error{Code: ErrorTimeout}
+	}
+	return f.result()
+}
+
+// 等所有的结果，超时返回 ErrorTimeout
+func waitAll(timeout time.Duration, fs []*Future) *Error {
+	deadline := time.Now().Add(timeout)
+	for _, f := range fs {
+		// 调用本身返回的错误不算，没等到结果才算
+		if _, err := f.await(time.Until(deadline)); err != nil && !f.isDone() {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Future) isDone() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 等任意一个结果，返回它的下标
+func waitAny(timeout time.Duration, fs []*Future) (int, *Error) {
+	for i, f := range fs {
+		if f.isDone() {
+			return i, nil
+		}
+	}
+	cases := make([]reflect.SelectCase, 0, len(fs)*2+1)
+	for _, f := range fs {
+		cases = append(cases,
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.done)},
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.svr.done)})
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.C)})
+	chosen, _, _ := reflect.Select(cases)
+	if chosen == len(cases)-1 {
+		return -1, &Error{Code: ErrorTimeout}
+	}
+	f := fs[chosen/2]
+	if chosen%2 == 1 {
+		f.svrExit()
+	}
+	return chosen / 2, nil
+}
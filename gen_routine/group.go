@@ -1,105 +1,321 @@
 package gen_routine
 
-import "sync"
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
 
-// 分组里面有哪些svr
-type subMap map[interface{}]*Svr
+// 分组按 key 分片，减少锁冲突
+const grpShardCount = 64
 
-// 分组map
-type groupMap map[interface{}]subMap
+// GroupJoined 分组成员加入事件，发给关注这个分组的协程
+type GroupJoined struct {
+	Key interface{}
+	Svr *Svr
+}
+
+// GroupLeft 分组成员离开事件，发给关注这个分组的协程
+// 主动离开时 Reason 为 ErrorNormalStop，协程退出时为退出原因
+type GroupLeft struct {
+	Key    interface{}
+	Svr    *Svr
+	Reason *Error
+}
+
+// 一个分组里有哪些svr
+type grpSet struct {
+	members  map[*Svr]struct{}
+	watchers map[*Svr]struct{} // 关注成员变化的svr
+	snap     []*Svr            // 成员快照，成员变化时置空，用到时再重建
+}
 
-// svr 在哪些分组里的 map, key : svr.key value : []group key
-type svrMap map[interface{}]map[interface{}]bool
+func (set *grpSet) empty() bool {
+	return len(set.members) == 0 && len(set.watchers) == 0
+}
 
+func (set *grpSet) watcherList() []*Svr {
+	if len(set.watchers) == 0 {
+		return nil
+	}
+	a := make([]*Svr, 0, len(set.watchers))
+	for w := range set.watchers {
+		a = append(a, w)
+	}
+	return a
+}
+
+// 分组事件，在锁外面再投递
+type grpEvent struct {
+	watchers []*Svr
+	msg      Msg
+}
+
+// 和分组广播一样，关注者邮箱满了直接丢掉并计数，不能卡住加入、离开以及退出的协程
+func notifyGrp(events []grpEvent) {
+	o := newCastOpts(nil)
+	for _, ev := range events {
+		castTo(ev.watchers, ev.msg, o)
+	}
+}
+
+// 分组不存在则新建，调用者需要持有分片的锁
+func (sh *grpShard) getOrNew(key interface{}) *grpSet {
+	set, ok := sh.grps[key]
+	if !ok {
+		set = &grpSet{members: map[*Svr]struct{}{}, watchers: map[*Svr]struct{}{}}
+		sh.grps[key] = set
+	}
+	return set
+}
+
+type grpShard struct {
+	grps map[interface{}]*grpSet
+	mux  sync.RWMutex
+}
+
+// group 分组注册表
+// svr 在哪些分组里记在 svr 自己身上，加锁顺序固定为先 svr 再分片
 type group struct {
-	svrGrp groupMap
-	svrKey svrMap
-	mux    sync.Mutex
+	shards [grpShardCount]grpShard
 }
 
-var grp *group
+func newGroup() *group {
+	grp := &group{}
+	for i := range grp.shards {
+		grp.shards[i].grps = map[interface{}]*grpSet{}
+	}
+	return grp
+}
 
-func initGrp() {
-	grp = &group{
-		svrGrp: groupMap{},
-		svrKey: svrMap{},
-		mux:    sync.Mutex{},
+// 分组 key 所在的分片
+func (grp *group) shard(key interface{}) *grpShard {
+	h := keyHash(key)
+	// 整数 key 一般是连续的，打散一下
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return &grp.shards[h%grpShardCount]
+}
+
+// key 的哈希，整数直接用
+func keyHash(key interface{}) uint64 {
+	var h uint64
+	switch k := key.(type) {
+	case int:
+		h = uint64(k)
+	case int32:
+		h = uint64(k)
+	case int64:
+		h = uint64(k)
+	case uint32:
+		h = uint64(k)
+	case uint64:
+		h = k
+	case string:
+		f := fnv.New64a()
+		f.Write([]byte(k))
+		h = f.Sum64()
+	case topicKey:
+		f := fnv.New64a()
+		f.Write([]byte(k))
+		h = f.Sum64()
+	default:
+		f := fnv.New64a()
+		fmt.Fprintf(f, "%T%v", key, key)
+		h = f.Sum64()
 	}
+	return h
 }
 
 // 将协程主测到一个分组当中
-func reg(key interface{}, svr *Svr) {
+func (grp *group) reg(key interface{}, svr *Svr) {
+	svr.grpMux.Lock()
+	if svr.grps[key] {
+		svr.grpMux.Unlock()
+		return
+	}
+	if svr.grps == nil {
+		svr.grps = map[interface{}]bool{}
+	}
+	svr.grps[key] = true
+
+	sh := grp.shard(key)
+	sh.mux.Lock()
+	set := sh.getOrNew(key)
+	set.members[svr] = struct{}{}
+	set.snap = nil
+	watchers := set.watcherList()
+	sh.mux.Unlock()
+	svr.grpMux.Unlock()
+
+	notifyGrp([]grpEvent{{watchers: watchers, msg: &GroupJoined{Key: key, Svr: svr}}})
+}
+
+// 将协程从某个分组中删除
+func (grp *group) unReq(key interface{}, svr *Svr) {
+	svr.grpMux.Lock()
+	if !svr.grps[key] {
+		svr.grpMux.Unlock()
+		return
+	}
+	delete(svr.grps, key)
+	ev := grp.remove(key, svr, &Error{Code: ErrorNormalStop})
+	svr.grpMux.Unlock()
+
+	notifyGrp([]grpEvent{ev})
+}
+
+// 从分片里删除，调用者需要持有 svr.grpMux
+func (grp *group) remove(key interface{}, svr *Svr, reason *Error) grpEvent {
+	sh := grp.shard(key)
+	sh.mux.Lock()
 	defer func() {
-		grp.mux.Unlock()
+		sh.mux.Unlock()
 	}()
-	grp.mux.Lock()
-	svrM, ok := grp.svrGrp[key]
+	set, ok := sh.grps[key]
 	if !ok {
-		svrM = subMap{}
-		grp.svrGrp[key] = svrM
+		return grpEvent{}
 	}
-	svrM[svr.key] = svr
-	a, ok := grp.svrKey[svr.key]
-	if !ok {
-		a = map[interface{}]bool{}
-		grp.svrKey[svr.key] = a
+	delete(set.members, svr)
+	set.snap = nil
+	if set.empty() {
+		delete(sh.grps, key)
 	}
-	a[key] = true
+	return grpEvent{watchers: set.watcherList(), msg: &GroupLeft{Key: key, Svr: svr, Reason: reason}}
 }
 
-// 将协程从某个分组中删除
-func unReq(key interface{}, svr *Svr) {
+// 关注分组成员变化
+func (grp *group) watch(key interface{}, svr *Svr) {
+	svr.grpMux.Lock()
+	defer func() {
+		svr.grpMux.Unlock()
+	}()
+	if svr.watch == nil {
+		svr.watch = map[interface{}]bool{}
+	}
+	svr.watch[key] = true
+
+	sh := grp.shard(key)
+	sh.mux.Lock()
 	defer func() {
-		grp.mux.Unlock()
+		sh.mux.Unlock()
 	}()
-	grp.mux.Lock()
+	sh.getOrNew(key).watchers[svr] = struct{}{}
+}
 
-	// 从服务在哪些组里删除
-	if subSvr, ok1 := grp.svrKey[svr.key]; ok1 {
-		delete(subSvr, key)
-		if len(subSvr) == 0 {
-			delete(grp.svrKey, svr.key)
-		}
+// 取消关注
+func (grp *group) unwatch(key interface{}, svr *Svr) {
+	svr.grpMux.Lock()
+	defer func() {
+		svr.grpMux.Unlock()
+	}()
+	if !svr.watch[key] {
+		return
 	}
+	delete(svr.watch, key)
+	grp.removeWatcher(key, svr)
+}
 
-	// 从哪些组里有服务删除
-	subM, ok := grp.svrGrp[key]
+// 调用者需要持有 svr.grpMux
+func (grp *group) removeWatcher(key interface{}, svr *Svr) {
+	sh := grp.shard(key)
+	sh.mux.Lock()
+	defer func() {
+		sh.mux.Unlock()
+	}()
+	set, ok := sh.grps[key]
 	if !ok {
 		return
 	}
-	delete(subM, svr.key)
-	if len(subM) == 0 {
-		delete(grp.svrGrp, key)
+	delete(set.watchers, svr)
+	if set.empty() {
+		delete(sh.grps, key)
 	}
 }
 
 // 协程退出，清理所有相关记录
-func bye(svr *Svr) {
+func (grp *group) bye(svr *Svr, reason *Error) {
+	svr.grpMux.Lock()
+	var events []grpEvent
+	for key := range svr.grps {
+		events = append(events, grp.remove(key, svr, reason))
+	}
+	svr.grps = nil
+	for key := range svr.watch {
+		grp.removeWatcher(key, svr)
+	}
+	svr.watch = nil
+	svr.grpMux.Unlock()
+
+	notifyGrp(events)
+}
+
+// 分组成员快照，返回的切片是共享的，不能修改
+func (grp *group) snapshot(key interface{}) []*Svr {
+	sh := grp.shard(key)
+	sh.mux.RLock()
+	set, ok := sh.grps[key]
+	if !ok || len(set.members) == 0 {
+		sh.mux.RUnlock()
+		return nil
+	}
+	if snap := set.snap; snap != nil {
+		sh.mux.RUnlock()
+		return snap
+	}
+	sh.mux.RUnlock()
+
+	sh.mux.Lock()
 	defer func() {
-		grp.mux.Unlock()
+		sh.mux.Unlock()
 	}()
-	grp.mux.Lock()
-	if svrM, ok1 := grp.svrKey[svr.key]; ok1 {
-		for grpK, _ := range svrM {
-			if m, ok := grp.svrGrp[grpK]; ok {
-				delete(m, svr.key)
-				if len(m) == 0 {
-					delete(grp.svrGrp, grpK)
-				}
-			}
+	set, ok = sh.grps[key]
+	if !ok || len(set.members) == 0 {
+		return nil
+	}
+	if set.snap == nil {
+		snap := make([]*Svr, 0, len(set.members))
+		for svr := range set.members {
+			snap = append(snap, svr)
 		}
+		set.snap = snap
 	}
-	delete(grp.svrKey, svr.key)
+	return set.snap
 }
 
 // allSvr 返回某个组里所有的svr
-func allSvr(key interface{}) []*Svr {
-	var a []*Svr
-	if subM, ok := grp.svrGrp[key]; ok {
-		for _, svr := range subM {
-			a = append(a, svr)
-		}
-		return a
+func (grp *group) allSvr(key interface{}) []*Svr {
+	snap := grp.snapshot(key)
+	if len(snap) == 0 {
+		return nil
 	}
-	return a
+	return append([]*Svr(nil), snap...)
+}
+
+// count 某个组里svr的数量
+func (grp *group) count(key interface{}) int {
+	sh := grp.shard(key)
+	sh.mux.RLock()
+	defer func() {
+		sh.mux.RUnlock()
+	}()
+	if set, ok := sh.grps[key]; ok {
+		return len(set.members)
+	}
+	return 0
+}
+
+// 是否在分组里
+func (grp *group) has(key interface{}, svr *Svr) bool {
+	sh := grp.shard(key)
+	sh.mux.RLock()
+	defer func() {
+		sh.mux.RUnlock()
+	}()
+	if set, ok := sh.grps[key]; ok {
+		_, in := set.members[svr]
+		return in
+	}
+	return false
 }
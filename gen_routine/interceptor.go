@@ -0,0 +1,107 @@
+package gen_routine
+
+import "runtime/debug"
+
+// Handler 处理一条消息
+type Handler func(msg Msg) (interface{}, *Error)
+
+// Interceptor 拦截器，包在逻辑模块的 HandleMsg 外面
+// 调 next 交给下一个拦截器，最后一个交给 HandleMsg；不调 next 则消息被拦下
+// 拦截器返回 ErrorRejected 表示拒绝这条消息，Call 的调用者会收到这个错误，协程不会退出
+// 逻辑模块自己返回的 ErrorRejected 还是和别的错误一样，协程退出
+// next 里崩了会一路 panic 上来，要自己处理崩溃用 Recover
+type Interceptor func(svr *Svr, msg Msg, next Handler) (interface{}, *Error)
+
+// Recover 处理崩溃的拦截器，崩溃照样打日志、计入崩溃次数，之后怎么办由 policy 决定
+// policy 返回 nil 协程接着跑，返回 ErrorRejected 拒绝这条消息，返回别的错误则协程以它退出
+// 崩溃时逻辑模块的状态可能只改了一半，确定能接着跑的才不退出
+func Recover(policy func(svr *Svr, msg Msg, crash *Error) *Error) Interceptor {
+	return func(svr *Svr, msg Msg, next Handler) (ret interface{}, err *Error) {
+		defer func() {
+			if r := recover(); r != nil {
+				crash := &Error{Code: ErrorCrash, ParamPanic: r, Param: string(debug.Stack())}
+				svr.mgr.rt.errorf("svr handle msg crash %v \n%s", crash.ParamPanic, crash.Param)
+				ret, err = nil, policy(svr, msg, crash)
+				// 返回崩溃的由 record 计数
+				if err == nil || err.Code != ErrorCrash {
+					svr.countCrash()
+				}
+			}
+		}()
+		return next(msg)
+	}
+}
+
+// 走拦截器处理逻辑模块的消息，记下是不是拦截器拒绝的
+func (svr *Svr) intercept(msg Msg) (interface{}, *Error) {
+	svr.modErr = nil
+	ret, err := svr.handler(msg)
+	if err != nil && err.Code == ErrorRejected && err != svr.modErr {
+		svr.rejected = err
+	}
+	return ret, err
+}
+
+// 注册管理器的拦截器，只对之后启动的协程生效
+func (mgr *Mgr) use(interceptors []Interceptor) {
+	mgr.icMux.Lock()
+	defer func() {
+		mgr.icMux.Unlock()
+	}()
+	mgr.interceptors = append(mgr.interceptors, interceptors...)
+}
+
+// 协程用到的拦截器，上层管理器的在外面，协程自己的在最里面
+func (mgr *Mgr) interceptorChain(own []Interceptor) []Interceptor {
+	var chain []Interceptor
+	for m := mgr; m != nil; m = m.parent {
+		m.icMux.RLock()
+		if len(m.interceptors) > 0 {
+			chain = append(append([]Interceptor(nil), m.interceptors...), chain...)
+		}
+		m.icMux.RUnlock()
+	}
+	return append(chain, own...)
+}
+
+// 把拦截器串起来，协程启动时建一次
+// 批量处理时每条消息也要过一遍拦截器，最里面换成先收集起来，再一起交给 HandleBatch
+func (svr *Svr) buildHandler(chain []Interceptor) {
+	svr.handler = wrapHandler(svr, chain, func(msg Msg) (interface{}, *Error) {
+		ret, err := svr.mod.HandleMsg(msg)
+		svr.modErr = err
+		return ret, err
+	})
+	if len(chain) > 0 {
+		svr.collect = wrapHandler(svr, chain, func(msg Msg) (interface{}, *Error) {
+			svr.batchBuf = append(svr.batchBuf, msg)
+			return nil, nil
+		})
+	}
+}
+
+func wrapHandler(svr *Svr, chain []Interceptor, h Handler) Handler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, next := chain[i], h
+		h = func(msg Msg) (interface{}, *Error) {
+			return ic(svr, msg, next)
+		}
+	}
+	return h
+}
+
+// 批量消息过一遍拦截器，返回放行的消息，被拒绝的跳过
+func (svr *Svr) interceptBatch(msgs []Msg) ([]Msg, *Error) {
+	if svr.collect == nil {
+		return msgs, nil
+	}
+	// HandleBatch 可能留着切片，每次都用新的
+	svr.batchBuf = nil
+	for _, msg := range msgs {
+		if _, err := svr.collect(msg); err != nil && err.Code != ErrorCodeOk && err.Code != ErrorRejected {
+			return nil, err
+		}
+	}
+	msgs, svr.batchBuf = svr.batchBuf, nil
+	return msgs, nil
+}
@@ -2,6 +2,7 @@ package gen_routine
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"sync/atomic"
 )
@@ -11,10 +12,24 @@ type Mgr struct {
 	m         sync.Map // 经测试，sync.Map 写比 map+mutex 慢一半不到的样子，读要快很多被
 	countSvr  int32
 	countMgr  int32
+	crashes   uint64 // 下面协程崩溃的总次数
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 	wait      *sync.WaitGroup
+	tasks     *sync.WaitGroup // Go 开的任务，管理器的 ctx 取消以后才等它们
+	countTask int32
 	parent    *Mgr
+	rt        *Runtime
+	sup       *supervisor // 不为nil 则是监督者，子协程退出时按策略重启
+	children  []*Mgr      // 子管理器，按创建顺序
+
+	stopping   int32
+	stopped    chan struct{}
+	stopReason *Error // 关闭原因，协程退出时传给 Terminate
+	stopRet    *Error // 关闭的结果，stopped 关了以后才能读
+
+	icMux        sync.RWMutex
+	interceptors []Interceptor // 下面所有协程的拦截器，包括子管理器的
 
 	lock sync.RWMutex
 }
@@ -22,27 +37,19 @@ type Mgr struct {
 type SvrImp interface {
 }
 
-// 单键管理器
-var mgrG *Mgr
-var maxRId uint64
-
+// BeforeMain 重置默认的运行环境
+// 换一套新的，不改老的，之前开的协程还是用原来的那套
 func BeforeMain() {
-	initRootMgr()
-	initGrp()
-}
-
-func initRootMgr() {
-	// 初始化全局管理器
-	mgrG = &Mgr{name: "global"}
-	mgrG.init(context.Background())
-	maxRId = 0
+	defaultRT = NewRuntime()
 }
 
 func (mgr *Mgr) init(parent context.Context) {
 	mgr.m = sync.Map{}
 	mgr.wait = &sync.WaitGroup{}
+	mgr.tasks = &sync.WaitGroup{}
 	mgr.ctx, mgr.ctxCancel = context.WithCancel(parent)
 	mgr.lock = sync.RWMutex{}
+	mgr.stopped = make(chan struct{})
 }
 
 // 创建子管理器
@@ -58,40 +65,122 @@ func newMgr(parent *Mgr, name string) (*Mgr, *Error) {
 	mgr.init(parent.ctx)
 	mgr.name = name
 	mgr.parent = parent
+	mgr.rt = parent.rt
+	parent.children = append(parent.children, mgr)
 	atomic.AddInt32(&parent.countMgr, 1)
 	return mgr, nil
 }
 
-// 分配一个新的协程编号
-func svrKey(k interface{}) interface{} {
-	if k == nil {
-		return atomic.AddUint64(&maxRId, 1)
+// 全部协程退出，先按创建的反序关掉子管理器
+// 同时关的等第一个关完，返回同样的结果
+func (mgr *Mgr) stop(reason *Error, o *stopOpts) (ret *Error) {
+	// 在要关的管理器下面的协程里关，比如 Terminate 里，等不到自己退出，只发起不等
+	if cur := mgr.rt.calls.current(); cur != nil && cur.mgr.under(mgr) {
+		go mgr.stop(reason, o)
+		return &Error{Code: ErrorDeadlock, Param: "stop mgr " + mgr.name + " from its own svr"}
+	}
+	if !atomic.CompareAndSwapInt32(&mgr.stopping, 0, 1) {
+		<-mgr.stopped
+		return mgr.stopRet
+	}
+	defer func() {
+		mgr.stopRet = ret
+		close(mgr.stopped)
+	}()
+	children := mgr.childMgr()
+	for i := len(children) - 1; i >= 0; i-- {
+		// 子管理器的结果是共享的，不能改，包一层再串起来
+		if err := children[i].stop(reason, o); err != nil {
+			ret = &Error{Code: err.Code, Param: fmt.Sprintf("child mgr %s\n%s", children[i].name, err.String()), Last: ret}
+		}
 	}
-	return k
+	mgr.stopReason = reason
+	ok := true
+	if o.drain {
+		ok = mgr.drainSvr(o, reason)
+	}
+	if ok {
+		mgr.ctxCancel()
+		ok = mgr.waitSvr(o, true)
+	}
+	if !ok {
+		stuck := mgr.stuckSvr()
+		mgr.rt.errorf("mgr %s stop deadline exceeded\n%s", mgr.name, stuck)
+		ret = &Error{Code: ErrorTimeout, Param: stuck, Last: ret}
+		mgr.ctxCancel()
+	}
+	if mgr.parent != nil {
+		mgr.parent.removeChild(mgr)
+	}
+	return ret
 }
 
-// 全部协程退出
-func (mgr *Mgr) stop(reason *Error) *Error {
-	mgr.ctxCancel()
-	mgr.wait.Wait()
-	atomic.AddInt32(&mgr.parent.countMgr, -1)
-	mgr.parent.unreg(mgr.name)
-	return nil
+// 是否是 parent 或者它下面的管理器
+func (mgr *Mgr) under(parent *Mgr) bool {
+	for m := mgr; m != nil; m = m.parent {
+		if m == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否正在关闭
+func (mgr *Mgr) isStopping() bool {
+	return atomic.LoadInt32(&mgr.stopping) == 1
+}
+
+// ctx 结束时协程退出的原因
+func (mgr *Mgr) ctxReason() *Error {
+	if mgr.stopReason != nil {
+		return mgr.stopReason
+	}
+	return &Error{Code: ErrorCtxDone}
+}
+
+func (mgr *Mgr) childMgr() []*Mgr {
+	mgr.lock.RLock()
+	defer func() {
+		mgr.lock.RUnlock()
+	}()
+	return append([]*Mgr(nil), mgr.children...)
+}
+
+// 子管理器关闭了，清理记录
+func (mgr *Mgr) removeChild(child *Mgr) {
+	mgr.lock.Lock()
+	defer func() {
+		mgr.lock.Unlock()
+	}()
+	for i, c := range mgr.children {
+		if c == child {
+			mgr.children = append(mgr.children[:i], mgr.children[i+1:]...)
+			break
+		}
+	}
+	atomic.AddInt32(&mgr.countMgr, -1)
+	mgr.unreg(child.name)
 }
 
 // 启动一个没名字的svr
-func (mgr *Mgr) newSvr(k interface{}, mod SvrBehavior) (*Svr, *Error) {
+func (mgr *Mgr) newSvr(k interface{}, mod SvrBehavior, opts ...SvrOption) (*Svr, *Error) {
 	mgr.lock.Lock()
 	defer func() {
 		mgr.lock.Unlock()
 	}()
+	// 正在关闭时不再开新的，排空邮箱时新开的协程收不到退出通知
+	if mgr.isStopping() {
+		return nil, &Error{Code: ErrorClosed, Param: mgr.name}
+	}
 	svr := mgr.svrBase(k, mod)
+	svr.opts = newSvrOpts(opts)
 	// 子管理器注册 先检查有没有老的
 	if old, loaded := mgr.reg(svr.key, svr); loaded {
 		return old.(*Svr), &Error{Code: ErrorAlreadyHad}
 	}
 	// 确定能注册成功则更新mod，以及启动协程
 	svr.mod = mod
+	svr.buildHandler(mgr.interceptorChain(svr.opts.interceptors))
 	err := svr.start(mgr)
 	if err != nil {
 		// 启动失败反注册
@@ -103,8 +192,8 @@ func (mgr *Mgr) newSvr(k interface{}, mod SvrBehavior) (*Svr, *Error) {
 }
 
 func (mgr *Mgr) svrBase(k interface{}, mod SvrBehavior) *Svr {
-	key := svrKey(k)
-	svr := &Svr{key: key}
+	key := mgr.rt.svrKey(k)
+	svr := &Svr{key: key, done: make(chan struct{}), sysC: make(chan struct{}, 1)}
 	return svr
 }
 
@@ -0,0 +1,127 @@
+package gen_routine
+
+// MonitorRef 监控的引用，用来取消监控
+type MonitorRef struct {
+	target *Svr
+}
+
+// MsgDown 被监控的协程退出后，发给监控者的消息，走 HandleMsg 处理
+type MsgDown struct {
+	Ref    *MonitorRef
+	Svr    *Svr
+	Reason *Error
+}
+
+// MsgExit 设置了 TrapExit 的协程，收到链接协程的退出消息，走 HandleMsg 处理
+type MsgExit struct {
+	Svr    *Svr
+	Reason *Error
+}
+
+// 监控某个协程
+func (svr *Svr) monitor(target *Svr) *MonitorRef {
+	ref := &MonitorRef{target: target}
+	target.relMux.Lock()
+	if !target.exited {
+		if target.monitors == nil {
+			target.monitors = map[*MonitorRef]*Svr{}
+		}
+		target.monitors[ref] = svr
+		target.relMux.Unlock()
+		return ref
+	}
+	target.relMux.Unlock()
+	// 已经退出了的，直接通知
+	svr.send(&MsgDown{Ref: ref, Svr: target, Reason: &Error{Code: ErrorClosed}})
+	return ref
+}
+
+// 取消监控
+func demonitor(ref *MonitorRef) {
+	target := ref.target
+	target.relMux.Lock()
+	defer func() {
+		target.relMux.Unlock()
+	}()
+	delete(target.monitors, ref)
+}
+
+// 双向链接两个协程
+func (svr *Svr) link(other *Svr) *Error {
+	if svr == other {
+		return nil
+	}
+	if !svr.addLink(other) {
+		return &Error{Code: ErrorClosed}
+	}
+	if !other.addLink(svr) {
+		svr.removeLink(other)
+		return &Error{Code: ErrorClosed}
+	}
+	return nil
+}
+
+func (svr *Svr) unlink(other *Svr) {
+	svr.removeLink(other)
+	other.removeLink(svr)
+}
+
+func (svr *Svr) addLink(other *Svr) bool {
+	svr.relMux.Lock()
+	defer func() {
+		svr.relMux.Unlock()
+	}()
+	if svr.exited {
+		return false
+	}
+	if svr.links == nil {
+		svr.links = map[*Svr]bool{}
+	}
+	svr.links[other] = true
+	return true
+}
+
+func (svr *Svr) removeLink(other *Svr) {
+	svr.relMux.Lock()
+	defer func() {
+		svr.relMux.Unlock()
+	}()
+	delete(svr.links, other)
+}
+
+func (svr *Svr) setTrapExit(trap bool) {
+	svr.relMux.Lock()
+	defer func() {
+		svr.relMux.Unlock()
+	}()
+	svr.trapExit = trap
+}
+
+// 协程退出，通知所有监控者以及链接的协程
+func (svr *Svr) notifyExit(reason *Error) {
+	svr.relMux.Lock()
+	svr.exited = true
+	monitors := svr.monitors
+	links := svr.links
+	svr.monitors = nil
+	svr.links = nil
+	svr.relMux.Unlock()
+
+	for ref, watcher := range monitors {
+		watcher.send(&MsgDown{Ref: ref, Svr: svr, Reason: reason})
+	}
+	for l := range links {
+		l.relMux.Lock()
+		delete(l.links, svr)
+		trap := l.trapExit
+		l.relMux.Unlock()
+		if trap {
+			l.send(&MsgExit{Svr: svr, Reason: reason})
+			continue
+		}
+		// 非正常退出才会把链接的协程一起带走
+		if !isNormalReason(reason) {
+			l.send(&MsgStop{reason: &Error{Code: ErrorLinkExit, Last: reason}})
+		}
+	}
+}
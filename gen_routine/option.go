@@ -0,0 +1,87 @@
+package gen_routine
+
+import "time"
+
+// Overflow 邮箱满了之后的处理策略
+// Call 不会被悄悄丢掉：丢消息的策略下 Call 邮箱满了直接返回 ErrorMailboxFull，被挤掉的 Call 也会收到 ErrorMailboxFull
+type Overflow int32
+
+const (
+	OverflowBlock        Overflow = iota // 一直等到有空位，协程退出了则返回
+	OverflowBlockTimeout                 // 等一段时间，超时返回 ErrorTimeout
+	OverflowDropNewest                   // 丢掉新来的消息
+	OverflowDropOldest                   // 丢掉邮箱里最老的消息
+	OverflowError                        // 直接返回 ErrorMailboxFull
+)
+
+// svrOpts 协程启动参数
+type svrOpts struct {
+	mailbox  int
+	overflow Overflow
+	timeout  time.Duration      // OverflowBlockTimeout 等待的时间
+	idle     time.Duration      // 空闲超时，为0 则不检查
+	idleIf   func(msg Msg) bool // 哪些消息算活跃，为nil 则邮箱里的消息都算
+	batch    int                // 一次最多批量处理多少条，小于2 则不批量
+
+	interceptors []Interceptor // 协程自己的拦截器，在管理器的里面
+}
+
+// SvrOption 协程启动参数设置
+type SvrOption func(o *svrOpts)
+
+func newSvrOpts(opts []SvrOption) svrOpts {
+	o := svrOpts{mailbox: receiveChanLen, overflow: OverflowBlock}
+	for _, f := range opts {
+		f(&o)
+	}
+	return o
+}
+
+// WithMailbox 设置邮箱容量，小于1 则使用默认值
+func WithMailbox(capacity int) SvrOption {
+	return func(o *svrOpts) {
+		if capacity > 0 {
+			o.mailbox = capacity
+		}
+	}
+}
+
+// WithOverflow 设置邮箱满了之后的策略，timeout 只对 OverflowBlockTimeout 有效
+func WithOverflow(policy Overflow, timeout time.Duration) SvrOption {
+	return func(o *svrOpts) {
+		o.overflow = policy
+		o.timeout = timeout
+	}
+}
+
+// WithIdleTimeout 设置空闲超时，d 时间内没收到消息则回调 IdleBehavior.HandleIdle
+// 逻辑模块没有实现 IdleBehavior 则直接以 ErrorNormalStop 退出
+func WithIdleTimeout(d time.Duration) SvrOption {
+	return func(o *svrOpts) {
+		o.idle = d
+	}
+}
+
+// WithIdleFilter 设置哪些消息算活跃，只有 f 返回 true 的消息才重新计算空闲时间
+// 比如玩家只算客户端发来的消息，房间广播之类的不算；Call 传给 f 的是调用的消息
+func WithIdleFilter(f func(msg Msg) bool) SvrOption {
+	return func(o *svrOpts) {
+		o.idleIf = f
+	}
+}
+
+// WithBatch 设置一次最多批量处理多少条消息，逻辑模块需要实现 BatchBehavior
+// Call、Exec 以及停止消息还是一条一条处理，顺序不变
+// 有拦截器时每条消息先过一遍拦截器，放行的再一起批量处理
+func WithBatch(n int) SvrOption {
+	return func(o *svrOpts) {
+		o.batch = n
+	}
+}
+
+// WithInterceptor 给协程加拦截器，按顺序从外到里，在管理器的拦截器里面
+func WithInterceptor(interceptors ...Interceptor) SvrOption {
+	return func(o *svrOpts) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
@@ -0,0 +1,192 @@
+package gen_routine
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Dispatch 协程池分派消息的方式
+type Dispatch int32
+
+const (
+	DispatchRoundRobin  Dispatch = iota // 轮流
+	DispatchLeastLoaded                 // 邮箱里排队最少的
+	DispatchHash                        // 按 key 的哈希，同一个 key 总是同一个协程，保证顺序
+)
+
+// poolOpts 协程池参数
+type poolOpts struct {
+	dispatch Dispatch
+	svrOpts  []SvrOption
+	flags    SupFlags
+}
+
+// PoolOption 协程池参数设置
+type PoolOption func(o *poolOpts)
+
+// WithDispatch 设置分派方式，默认轮流
+func WithDispatch(d Dispatch) PoolOption {
+	return func(o *poolOpts) {
+		o.dispatch = d
+	}
+}
+
+// WithWorkerOpts 设置每个工作协程的启动参数
+func WithWorkerOpts(opts ...SvrOption) PoolOption {
+	return func(o *poolOpts) {
+		o.svrOpts = opts
+	}
+}
+
+// WithPoolRestart 设置工作协程的重启频率，默认5秒内重启次数不超过工作协程的数量
+func WithPoolRestart(flags SupFlags) PoolOption {
+	return func(o *poolOpts) {
+		o.flags = flags
+	}
+}
+
+// Pool 协程池，工作协程受监督，崩溃后按原来的编号重启
+type Pool struct {
+	mgr      *Mgr
+	size     int
+	dispatch Dispatch
+	next     uint64
+	out      []int32  // 是否被借出去了
+	free     chan int // 可以借出的编号
+}
+
+func newPool(parent *Mgr, name string, size int, start func() SvrBehavior, opts []PoolOption) (*Pool, *Error) {
+	if size < 1 {
+		size = 1
+	}
+	o := poolOpts{}
+	for _, f := range opts {
+		f(&o)
+	}
+	// 工作协程都是 Permanent，默认允许每个协程在周期内重启一次
+	if o.flags.Period <= 0 {
+		o.flags = SupFlags{Strategy: OneForOne, Intensity: size, Period: defaultPeriod}
+	}
+	mgr, err := NewSupMgr(parent, name, o.flags)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pool{mgr: mgr, size: size, dispatch: o.dispatch, out: make([]int32, size), free: make(chan int, size)}
+	for i := 0; i < size; i++ {
+		if _, err := mgr.startChild(ChildSpec{Key: i, Start: start, Restart: Permanent, Opts: o.svrOpts}); err != nil {
+			mgr.stop(&Error{Code: ErrorRoutineInitFail, Last: err}, &stopOpts{})
+			return nil, err
+		}
+		p.free <- i
+	}
+	return p, nil
+}
+
+// 编号对应的工作协程，重启中返回nil
+func (p *Pool) worker(i int) *Svr {
+	v, ok := p.mgr.lookup(i)
+	if !ok {
+		return nil
+	}
+	svr, _ := v.(*Svr)
+	return svr
+}
+
+// 按分派方式挑一个工作协程
+func (p *Pool) pick(key interface{}) (*Svr, *Error) {
+	if p.mgr.isStopping() {
+		return nil, &Error{Code: ErrorClosed, Param: p.mgr.name}
+	}
+	var idx int
+	switch p.dispatch {
+	case DispatchHash:
+		idx = int(keyHash(key) % uint64(p.size))
+	case DispatchLeastLoaded:
+		idx = p.leastLoaded()
+	default:
+		idx = p.roundRobin()
+	}
+	svr := p.worker(idx)
+	if svr == nil {
+		return nil, &Error{Code: ErrorNotFind, Param: fmt.Sprintf("%s/%d", p.mgr.name, idx)}
+	}
+	return svr, nil
+}
+
+// 轮流，跳过借出去的，都借出去了就不跳了
+func (p *Pool) roundRobin() int {
+	start := atomic.AddUint64(&p.next, 1)
+	for i := 0; i < p.size; i++ {
+		idx := int((start + uint64(i)) % uint64(p.size))
+		if atomic.LoadInt32(&p.out[idx]) == 0 {
+			return idx
+		}
+	}
+	return int(start % uint64(p.size))
+}
+
+// 邮箱里排队最少的，跳过借出去的
+func (p *Pool) leastLoaded() int {
+	best, bestLen := -1, 0
+	for i := 0; i < p.size; i++ {
+		if atomic.LoadInt32(&p.out[i]) == 1 {
+			continue
+		}
+		svr := p.worker(i)
+		if svr == nil {
+			continue
+		}
+		if l := len(svr.receive); best < 0 || l < bestLen {
+			best, bestLen = i, l
+		}
+	}
+	if best < 0 {
+		return p.roundRobin()
+	}
+	return best
+}
+
+// 借出一个工作协程，归还前不会再借给别人，也不参与轮流以及最少排队的分派
+// 按 key 分派的池同一个 key 只能是同一个协程，借出去也得接着收，不能独占，所以不能借
+func (p *Pool) checkout(timeout time.Duration) (*Svr, *Error) {
+	if p.dispatch == DispatchHash {
+		return nil, &Error{Code: ErrorPoolDispatch, Param: "checkout on hash pool " + p.mgr.name}
+	}
+	if p.mgr.isStopping() {
+		return nil, &Error{Code: ErrorClosed, Param: p.mgr.name}
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case idx := <-p.free:
+			svr := p.worker(idx)
+			if svr == nil {
+				// 正在重启，放回去等下一个
+				p.free <- idx
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			atomic.StoreInt32(&p.out[idx], 1)
+			return svr, nil
+		case <-p.mgr.ctx.Done():
+			return nil, &Error{Code: ErrorClosed, Param: p.mgr.name}
+		case <-t.C:
+			return nil, &Error{Code: ErrorTimeout}
+		}
+	}
+}
+
+// 归还借出的工作协程，重启过的也按编号归还
+func (p *Pool) checkin(svr *Svr) *Error {
+	idx, ok := svr.key.(int)
+	if !ok || svr.mgr != p.mgr || idx < 0 || idx >= p.size {
+		return &Error{Code: ErrorNotFind}
+	}
+	if !atomic.CompareAndSwapInt32(&p.out[idx], 1, 0) {
+		return &Error{Code: ErrorNotFind, Param: "not checked out"}
+	}
+	p.free <- idx
+	return nil
+}
@@ -0,0 +1,208 @@
+package gen_routine
+
+import (
+	"strings"
+	"sync"
+)
+
+// 主题订阅建在分组上面：每个订阅的 pattern 就是一个分组
+// 带通配符的 pattern 另外放在前缀树里，发布时找出所有匹配的 pattern 再合并成员
+
+const (
+	topicSep      = "."
+	topicAnyOne   = "*" // 匹配一层
+	topicAnyTrail = "#" // 匹配剩下的零到多层，只能放最后
+)
+
+// 主题在分组里的 key，和普通分组区分开
+type topicKey string
+
+// MsgPub 发布到主题的消息，走 HandleMsg 处理
+type MsgPub struct {
+	Topic string
+	Msg   Msg
+}
+
+type topicNode struct {
+	children map[string]*topicNode
+	pattern  string // 不为空表示有订阅在这里结束
+}
+
+type pubsub struct {
+	grp  *group
+	mux  sync.RWMutex
+	root *topicNode
+}
+
+func newPubsub(grp *group) *pubsub {
+	return &pubsub{grp: grp, root: &topicNode{}}
+}
+
+// 拆分主题，wildcard 表示是否允许通配符
+func splitTopic(topic string, wildcard bool) ([]string, bool) {
+	if topic == "" {
+		return nil, false
+	}
+	segs := strings.Split(topic, topicSep)
+	for i, seg := range segs {
+		if seg == "" {
+			return nil, false
+		}
+		if seg == topicAnyOne || seg == topicAnyTrail {
+			if !wildcard || (seg == topicAnyTrail && i != len(segs)-1) {
+				return nil, false
+			}
+			continue
+		}
+		if strings.ContainsAny(seg, topicAnyOne+topicAnyTrail) {
+			return nil, false
+		}
+	}
+	return segs, true
+}
+
+func hasWildcard(segs []string) bool {
+	for _, seg := range segs {
+		if seg == topicAnyOne || seg == topicAnyTrail {
+			return true
+		}
+	}
+	return false
+}
+
+// 订阅主题
+func (ps *pubsub) subscribe(pattern string, svr *Svr) *Error {
+	segs, ok := splitTopic(pattern, true)
+	if !ok {
+		return &Error{Code: ErrorTopic, Param: pattern}
+	}
+	ps.mux.Lock()
+	defer func() {
+		ps.mux.Unlock()
+	}()
+	if hasWildcard(segs) {
+		node := ps.root
+		for _, seg := range segs {
+			next, ok := node.children[seg]
+			if !ok {
+				if node.children == nil {
+					node.children = map[string]*topicNode{}
+				}
+				next = &topicNode{}
+				node.children[seg] = next
+			}
+			node = next
+		}
+		node.pattern = pattern
+	}
+	ps.grp.reg(topicKey(pattern), svr)
+	return nil
+}
+
+// 取消订阅
+func (ps *pubsub) unsubscribe(pattern string, svr *Svr) {
+	ps.mux.Lock()
+	defer func() {
+		ps.mux.Unlock()
+	}()
+	ps.grp.unReq(topicKey(pattern), svr)
+	ps.prune(pattern)
+}
+
+// 协程退出，退出所有分组以及订阅
+func (ps *pubsub) bye(svr *Svr, reason *Error) {
+	var patterns []string
+	svr.grpMux.Lock()
+	for key := range svr.grps {
+		if k, ok := key.(topicKey); ok {
+			patterns = append(patterns, string(k))
+		}
+	}
+	svr.grpMux.Unlock()
+
+	ps.grp.bye(svr, reason)
+	if len(patterns) == 0 {
+		return
+	}
+	ps.mux.Lock()
+	defer func() {
+		ps.mux.Unlock()
+	}()
+	for _, pattern := range patterns {
+		ps.prune(pattern)
+	}
+}
+
+// 通配的 pattern 没人订阅了，从前缀树里删掉，调用者需要持有 ps.mux
+func (ps *pubsub) prune(pattern string) {
+	segs, ok := splitTopic(pattern, true)
+	if !ok || !hasWildcard(segs) || ps.grp.count(topicKey(pattern)) > 0 {
+		return
+	}
+	path := []*topicNode{ps.root}
+	for _, seg := range segs {
+		next, ok := path[len(path)-1].children[seg]
+		if !ok {
+			return
+		}
+		path = append(path, next)
+	}
+	path[len(path)-1].pattern = ""
+	// 从叶子往上删掉空节点
+	for i := len(segs) - 1; i >= 0; i-- {
+		node := path[i+1]
+		if node.pattern != "" || len(node.children) > 0 {
+			break
+		}
+		delete(path[i].children, segs[i])
+	}
+}
+
+// 找出所有匹配主题的通配 pattern
+func (node *topicNode) match(segs []string, keys []interface{}) []interface{} {
+	if trail, ok := node.children[topicAnyTrail]; ok && trail.pattern != "" {
+		keys = append(keys, topicKey(trail.pattern))
+	}
+	if len(segs) == 0 {
+		if node.pattern != "" {
+			keys = append(keys, topicKey(node.pattern))
+		}
+		return keys
+	}
+	if next, ok := node.children[segs[0]]; ok {
+		keys = next.match(segs[1:], keys)
+	}
+	if next, ok := node.children[topicAnyOne]; ok {
+		keys = next.match(segs[1:], keys)
+	}
+	return keys
+}
+
+// 发布消息，同一个协程只投递一次
+func (ps *pubsub) publish(topic string, msg Msg, opts []CastOption) (CastStats, *Error) {
+	segs, ok := splitTopic(topic, false)
+	if !ok {
+		return CastStats{}, &Error{Code: ErrorTopic, Param: topic}
+	}
+	keys := []interface{}{topicKey(topic)}
+	ps.mux.RLock()
+	keys = ps.root.match(segs, keys)
+	ps.mux.RUnlock()
+
+	var svrs []*Svr
+	if len(keys) == 1 {
+		svrs = ps.grp.snapshot(keys[0])
+	} else {
+		seen := map[*Svr]struct{}{}
+		for _, k := range keys {
+			for _, svr := range ps.grp.snapshot(k) {
+				if _, ok := seen[svr]; ok {
+					continue
+				}
+				seen[svr] = struct{}{}
+				svrs = append(svrs, svr)
+			}
+		}
+	}
+	return castTo(svrs, &MsgPub{Topic: topic, Msg: msg}, newCastOpts(opts)), nil
+}
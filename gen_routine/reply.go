@@ -0,0 +1,29 @@
+package gen_routine
+
+import "sync/atomic"
+
+type noReply struct{}
+
+// NoReply HandleMsg 返回它表示现在不回复，之后通过 Reply 回复
+var NoReply interface{} = &noReply{}
+
+// ReplyTo 调用的回复凭证，可以交给别的协程保存
+type ReplyTo struct {
+	call *MsgCall
+}
+
+// 回复调用者，只有第一次有效
+func (call *MsgCall) reply(ret interface{}, err *Error) bool {
+	if !atomic.CompareAndSwapInt32(&call.replied, 0, 1) {
+		return false
+	}
+	if call.fut != nil {
+		return call.fut.resolve(&MsgRet{ret: ret, err: err})
+	}
+	if call.ctx.Err() != nil || atomic.LoadInt32(&call.abandoned) == 1 {
+		return false
+	}
+	// retChan 有一个缓冲，不会卡住回复者
+	call.retChan <- &MsgRet{ret: ret, err: err}
+	return true
+}
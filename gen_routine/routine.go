@@ -1,6 +1,7 @@
 package gen_routine
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"runtime/debug"
@@ -21,17 +22,36 @@ type SvrBehavior interface {
 	Init(*Svr) *Error
 }
 
+// IdleBehavior 可选接口，设置了空闲超时的协程空闲时回调
+type IdleBehavior interface {
+	// HandleIdle 返回nil 则继续运行，否则以返回的原因退出
+	HandleIdle() *Error
+}
+
+// BatchBehavior 可选接口，设置了 WithBatch 的协程一次处理邮箱里排队的多条普通消息
+type BatchBehavior interface {
+	// HandleBatch 按收到的顺序处理，返回错误则协程退出
+	HandleBatch(msgs []Msg) *Error
+}
+
 type Logger interface {
 	Errorf(fmt string, args ...interface{})
 }
 
-// SetLogger 设置日志输出接口
+// SetLogger 设置默认运行环境的日志输出接口
 func SetLogger(l Logger) {
-	logger = l
+	defaultRT.SetLogger(l)
+}
+
+// SetDeadLetterHandler 设置默认运行环境的死信处理
+// 发给已经退出的协程的消息都会返回 ErrorClosed，同时交给死信处理并计数
+func SetDeadLetterHandler(h DeadLetterHandler) {
+	defaultRT.SetDeadLetterHandler(h)
 }
 
+// RootMgr 默认运行环境的根管理器
 func RootMgr() *Mgr {
-	return mgrG
+	return defaultRT.root
 }
 
 // NewMgr 开一个管理器
@@ -40,9 +60,9 @@ func NewMgr(parent *Mgr, name string) (*Mgr, *Error) {
 }
 
 // NewSvr 开个协程
-// k 为nil 则自动生成uint64的 rid
-func (mgr *Mgr) NewSvr(k interface{}, mod SvrBehavior) (*Svr, *Error) {
-	return mgr.newSvr(k, mod)
+// k 为nil 则自动生成uint64的 rid，管理器正在关闭则返回 ErrorClosed
+func (mgr *Mgr) NewSvr(k interface{}, mod SvrBehavior, opts ...SvrOption) (*Svr, *Error) {
+	return mgr.newSvr(k, mod, opts...)
 }
 
 // LookupMgr 查询管理器
@@ -55,6 +75,11 @@ func (mgr *Mgr) LookupSvr(k interface{}) (interface{}, bool) {
 	return mgr.lookup(k)
 }
 
+// Key 协程的 key
+func (svr *Svr) Key() interface{} {
+	return svr.key
+}
+
 // GetMod 获取逻辑模块
 func (svr *Svr) GetMod() SvrBehavior {
 	return svr.mod
@@ -65,25 +90,39 @@ func (mgr *Mgr) Foreach(f func(k interface{}, v interface{}) bool) {
 	mgr.foreach(f)
 }
 
-// StopMgr 关某个管理器
-func (mgr *Mgr) StopMgr(reason *Error) *Error {
-	return mgr.stop(reason)
+// StopMgr 关某个管理器，先按创建的反序关掉子管理器，reason 会传到每个协程的 Terminate
+// 默认直接通知协程退出，不处理还在排队的消息，可以通过 WithDrain 以及 WithDeadline 调整
+// 超过截止时间还没退出的协程会带上堆栈返回 ErrorTimeout
+// 在要关的管理器下面的协程里调用（比如 Terminate 里）等不到自己退出，会在后台接着关并直接返回 ErrorDeadlock
+func (mgr *Mgr) StopMgr(reason *Error, opts ...StopOption) *Error {
+	return mgr.stop(reason, newStopOpts(opts))
 }
 
-// StopSvr 停掉协程
+// StopSvr 停掉协程，协程已经退出了则直接返回
+// 走控制通道，邮箱满了也不会卡住，邮箱里还没处理的消息转成死信
 func (svr *Svr) StopSvr(reason *Error) {
-	svr.receive <- &MsgStop{reason: reason}
+	svr.send(&MsgStop{reason: reason})
 }
 
-// Cast 不关心返回值的调用
+// Cast 不关心返回值的调用，邮箱满了按协程的 Overflow 策略处理
 func (svr *Svr) Cast(msg Msg) {
-	svr.receive <- msg
+	svr.push(context.Background(), msg, svr.opts.overflow)
+}
+
+// TryCast 同 Cast，但是会返回投递失败的原因，比如 ErrorClosed
+// 策略为 OverflowBlock 时不等待，邮箱满了直接返回 ErrorMailboxFull
+func (svr *Svr) TryCast(msg Msg) *Error {
+	policy := svr.opts.overflow
+	if policy == OverflowBlock {
+		policy = OverflowError
+	}
+	return svr.push(context.Background(), msg, policy)
 }
 
-// CallInfinity 不带超时的调用，其实是很长的一个时间
-// Call 接口一定要注意，不要自己协程调到自己头上了！！！！！！
+// CallInfinity 不带超时的调用
+// 自己调自己或者形成环的调用会直接返回 ErrorDeadlock
 func (svr *Svr) CallInfinity(msg Msg) (interface{}, *Error) {
-	return svr.call(msg, Infinity)
+	return svr.callCtx(context.Background(), msg)
 }
 
 // Call 带超时的阻塞调用
@@ -91,8 +130,77 @@ func (svr *Svr) Call(msg Msg, timeout time.Duration) (interface{}, *Error) {
 	return svr.call(msg, timeout)
 }
 
+// CallCtx 阻塞调用，ctx 取消或者到期则返回
+// 处理方可以通过 CallContext 拿到调用者的 ctx
+func (svr *Svr) CallCtx(ctx context.Context, msg Msg) (interface{}, *Error) {
+	return svr.callCtx(ctx, msg)
+}
+
+// CallAsync 异步调用，马上返回，之后通过 Future 拿结果
+// 不会等邮箱空位，邮箱满了 Future 直接是 ErrorMailboxFull
+func (svr *Svr) CallAsync(msg Msg) *Future {
+	return svr.callAsync(msg)
+}
+
+// Await 等待异步调用的结果，超时返回 ErrorTimeout，之后还可以继续等
+// 目标协程退出了还没回复返回 ErrorClosed
+func (f *Future) Await(timeout time.Duration) (interface{}, *Error) {
+	return f.await(timeout)
+}
+
+// Cancel 取消异步调用，还没处理的不会再处理，之后 Await 返回 ErrorCtxDone
+// 已经有结果了返回 false
+func (f *Future) Cancel() bool {
+	return f.resolve(&MsgRet{err: &Error{Code: ErrorCtxDone}})
+}
+
+// WaitAll 等所有的异步调用都有结果，超时返回 ErrorTimeout，结果再通过各自的 Await 拿
+func WaitAll(timeout time.Duration, fs ...*Future) *Error {
+	return waitAll(timeout, fs)
+}
+
+// WaitAny 等任意一个异步调用有结果，返回它的下标，超时返回 -1 以及 ErrorTimeout
+func WaitAny(timeout time.Duration, fs ...*Future) (int, *Error) {
+	return waitAny(timeout, fs)
+}
+
+// CallContext 正在处理的调用的 ctx，只能在协程内处理消息时调用
+// 不是在处理 Call 则返回 context.Background()
+func (svr *Svr) CallContext() context.Context {
+	if svr.curCall == nil {
+		return context.Background()
+	}
+	return svr.curCall.ctx
+}
+
+// ReplyTo 正在处理的调用的回复凭证，只能在协程内处理消息时调用
+// 拿到凭证后 HandleMsg 返回 NoReply，之后在任意协程里用 Reply 回复，调用者的超时照常生效
+// 不是在处理 Call 则返回 nil
+func (svr *Svr) ReplyTo() *ReplyTo {
+	if svr.curCall == nil {
+		return nil
+	}
+	return &ReplyTo{call: svr.curCall}
+}
+
+// Reply 回复延后处理的调用，可以在任意协程里调用
+// 同一个调用只有第一次回复有效，已经回复过、调用者已经不等了返回 false
+func Reply(to *ReplyTo, ret interface{}, err *Error) bool {
+	if to == nil {
+		return false
+	}
+	return to.call.reply(ret, err)
+}
+
 // SyncExec 直接在协程中调用某个函数
 func (svr *Svr) SyncExec(f interface{}, timeout time.Duration, args ...interface{}) ([]interface{}, *Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return svr.SyncExecCtx(ctx, f, args...)
+}
+
+// SyncExecCtx 直接在协程中调用某个函数，ctx 取消或者到期则返回
+func (svr *Svr) SyncExecCtx(ctx context.Context, f interface{}, args ...interface{}) ([]interface{}, *Error) {
 	in, err := execIn(f, args...)
 	if err != nil {
 		return nil, err
@@ -102,7 +210,10 @@ func (svr *Svr) SyncExec(f interface{}, timeout time.Duration, args ...interface
 		args:   in,
 		isSync: true,
 	}
-	ret, err := svr.call(msg, timeout)
+	ret, err := svr.callCtx(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
 	retA := ret.([]reflect.Value)
 	retV := make([]interface{}, len(retA))
 	for i, v := range retA {
@@ -138,12 +249,27 @@ func execIn(f interface{}, args ...interface{}) ([]reflect.Value, *Error) {
 	}
 	in := make([]reflect.Value, lenA)
 	for i, arg := range args {
+		et := ft.In(i)
+		if arg == nil {
+			switch et.Kind() {
+			case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+				in[i] = reflect.Zero(et)
+				continue
+			}
+			return nil, &Error{Code: ErrorReflectParamsType, Param: fmt.Sprintf("arg %d expected : %s, actual : nil", i, et)}
+		}
 		in[i] = reflect.ValueOf(arg)
+		if !in[i].Type().AssignableTo(et) {
+			return nil, &Error{Code: ErrorReflectParamsType, Param: fmt.Sprintf("arg %d expected : %s, actual : %s", i, et, in[i].Type())}
+		}
 	}
 	return in, nil
 }
 
-// JustRun 不需要管理器，直接开一个协程跑个函数
+// JustRun 不需要管理器，直接开一个协程跑个函数，崩溃了打日志
+// 不算在任何管理器里，关闭时不会等它，管理器关了也照样跑
+//
+// Deprecated: 用 Go，可以等结果、取消，并且受管理器管理
 func JustRun(work func()) {
 	go func() {
 		defer func() {
@@ -159,20 +285,321 @@ func JustRun(work func()) {
 
 // GrpReg 在分组中注册
 func (svr *Svr) GrpReg(grpKey interface{}) {
-	reg(grpKey, svr)
+	svr.mgr.rt.grp.reg(grpKey, svr)
 }
 
 // GrpUnReq 从指定分组中反注册
 func (svr *Svr) GrpUnReq(grpKey interface{}) {
-	unReq(grpKey, svr)
+	svr.mgr.rt.grp.unReq(grpKey, svr)
 }
 
-// GrpAll 获取某个分组中所有协程
+// GrpAll 获取默认运行环境某个分组中所有协程
 func GrpAll(grpKey interface{}) []*Svr {
-	return allSvr(grpKey)
+	return defaultRT.GrpAll(grpKey)
+}
+
+// GrpCast 给默认运行环境某个分组中所有协程投递消息，返回投递结果
+// 默认成员邮箱满了直接丢掉，不会被某个处理慢的成员卡住
+func GrpCast(grpKey interface{}, msg Msg, opts ...CastOption) CastStats {
+	return defaultRT.GrpCast(grpKey, msg, opts...)
 }
 
-// GrpByeBye 协程退出，通知清理
+// GrpCount 默认运行环境某个分组中协程的数量
+func GrpCount(grpKey interface{}) int {
+	return defaultRT.GrpCount(grpKey)
+}
+
+// GrpByeBye 退出所有分组并取消所有关注，协程退出时会自动清理
 func (svr *Svr) GrpByeBye() {
-	bye(svr)
+	svr.mgr.rt.ps.bye(svr, &Error{Code: ErrorNormalStop})
+}
+
+// GrpWatch 关注分组成员变化，之后会收到 *GroupJoined 以及 *GroupLeft 消息
+// 邮箱满了的通知直接丢掉，计入 Dropped
+func (svr *Svr) GrpWatch(grpKey interface{}) {
+	svr.mgr.rt.grp.watch(grpKey, svr)
+}
+
+// GrpUnwatch 取消关注分组成员变化
+func (svr *Svr) GrpUnwatch(grpKey interface{}) {
+	svr.mgr.rt.grp.unwatch(grpKey, svr)
+}
+
+// =========== 主题订阅相关接口 ===========
+
+// Subscribe 订阅主题，主题用 . 分隔层级，* 匹配一层，# 放在最后匹配剩下的零到多层
+// 例如 room.*.system 匹配 room.100.system，guild.# 匹配 guild 以及 guild 开头的所有主题
+func (svr *Svr) Subscribe(pattern string) *Error {
+	return svr.mgr.rt.ps.subscribe(pattern, svr)
+}
+
+// Unsubscribe 取消订阅，pattern 要和订阅时一致
+func (svr *Svr) Unsubscribe(pattern string) {
+	svr.mgr.rt.ps.unsubscribe(pattern, svr)
+}
+
+// Publish 发布消息到主题，主题里不能有通配符
+// 同一个协程有多个订阅匹配也只收到一次 *MsgPub，投递方式和 GrpCast 一样
+func Publish(topic string, msg Msg, opts ...CastOption) (CastStats, *Error) {
+	return defaultRT.Publish(topic, msg, opts...)
+}
+
+// =========== 监督相关接口 ===========
+
+// NewSupMgr 开一个监督者管理器，通过 StartChild 启动的协程退出后会按 flags 重启
+func NewSupMgr(parent *Mgr, name string, flags SupFlags) (*Mgr, *Error) {
+	mgr, err := newMgr(parent, name)
+	if err != nil {
+		return mgr, err
+	}
+	mgr.sup = newSupervisor(flags)
+	return mgr, nil
+}
+
+// StartChild 启动一个受监督的协程
+func (mgr *Mgr) StartChild(spec ChildSpec) (*Svr, *Error) {
+	return mgr.startChild(spec)
+}
+
+// TerminateChild 关掉受监督的协程，之后不再重启
+// 子协程里关自己只发通知不等它退出，返回 ErrorDeadlock
+func (mgr *Mgr) TerminateChild(k interface{}, reason *Error) *Error {
+	return mgr.terminateChild(k, reason)
+}
+
+// =========== 监控与链接相关接口 ===========
+
+// Monitor 监控另一个协程，它退出后会收到 *MsgDown 消息
+func (svr *Svr) Monitor(other *Svr) *MonitorRef {
+	return svr.monitor(other)
+}
+
+// Demonitor 取消监控
+func (svr *Svr) Demonitor(ref *MonitorRef) {
+	demonitor(ref)
+}
+
+// Link 链接两个协程，任何一方非正常退出，另一方也会跟着退出
+// 对方已经退出了则返回 ErrorClosed
+func (svr *Svr) Link(other *Svr) *Error {
+	return svr.link(other)
+}
+
+// Unlink 取消链接
+func (svr *Svr) Unlink(other *Svr) {
+	svr.unlink(other)
+}
+
+// TrapExit 设置后，链接的协程退出不会带走自己，而是收到 *MsgExit 消息
+func (svr *Svr) TrapExit(trap bool) {
+	svr.setTrapExit(trap)
+}
+
+// =========== 定时器相关接口 ===========
+
+// SendAfter d 时间后给协程自己发一个消息，协程退出时自动取消
+func (svr *Svr) SendAfter(d time.Duration, msg Msg) *Timer {
+	return svr.startTimer(d, 0, msg)
+}
+
+// Tick 每隔 interval 给协程自己发一个消息，协程退出时自动取消
+func (svr *Svr) Tick(interval time.Duration, msg Msg) *Timer {
+	return svr.startTimer(interval, interval, msg)
+}
+
+// Cancel 取消定时器，返回定时器取消前是否还有效
+func (tm *Timer) Cancel() bool {
+	return tm.cancel()
+}
+
+// =========== 类型安全的调用接口 ===========
+
+// Exec 在协程中调用 f，但不关心结果，f 的参数为协程的逻辑模块
+func Exec[B SvrBehavior](svr *Svr, f func(mod B)) *Error {
+	if err := modOf[B](svr); err != nil {
+		return err
+	}
+	msg := &MsgFn{
+		f: func(mod SvrBehavior) interface{} {
+			f(mod.(B))
+			return nil
+		},
+		isSync: false,
+	}
+	svr.Cast(msg)
+	return nil
+}
+
+// CallFn 在协程中调用 f 并等待结果，f 的参数为协程的逻辑模块
+func CallFn[B SvrBehavior, R any](svr *Svr, f func(mod B) R, timeout time.Duration) (R, *Error) {
+	var r R
+	if err := modOf[B](svr); err != nil {
+		return r, err
+	}
+	msg := &MsgFn{
+		f: func(mod SvrBehavior) interface{} {
+			return f(mod.(B))
+		},
+		isSync: true,
+	}
+	ret, err := svr.call(msg, timeout)
+	if err != nil {
+		return r, err
+	}
+	r, _ = ret.(R)
+	return r, nil
+}
+
+// =========== 事件管理器相关接口 ===========
+
+// NewEventMgr 在管理器下开一个事件管理器协程，opts 和 NewSvr 一样，设置 WithBatch 则批量交给处理
+func NewEventMgr(mgr *Mgr, k interface{}, opts ...SvrOption) (*EventMgr, *Error) {
+	return newEventMgr(mgr, k, opts)
+}
+
+// Svr 事件管理器的协程
+func (em *EventMgr) Svr() *Svr {
+	return em.svr
+}
+
+// AddHandler 加一个事件处理，id 重复返回 ErrorAlreadyHad
+func (em *EventMgr) AddHandler(id interface{}, h EventHandler, timeout time.Duration) *Error {
+	return em.exec(func(eb *eventBehavior) *Error {
+		return eb.add(id, h)
+	}, timeout)
+}
+
+// RemoveHandler 删掉一个事件处理，找不到返回 ErrorNotFind
+func (em *EventMgr) RemoveHandler(id interface{}, timeout time.Duration) *Error {
+	return em.exec(func(eb *eventBehavior) *Error {
+		return eb.remove(id, nil)
+	}, timeout)
+}
+
+// Handlers 当前所有事件处理的 id，按加入的顺序
+func (em *EventMgr) Handlers(timeout time.Duration) ([]interface{}, *Error) {
+	return CallFn(em.svr, func(eb *eventBehavior) []interface{} {
+		return eb.ids()
+	}, timeout)
+}
+
+// Notify 通知事件，不等处理完
+func (em *EventMgr) Notify(event Msg) {
+	em.svr.Cast(event)
+}
+
+// SyncNotify 通知事件，等所有处理都处理完
+func (em *EventMgr) SyncNotify(event Msg, timeout time.Duration) *Error {
+	_, err := em.svr.Call(event, timeout)
+	return err
+}
+
+// =========== 任务相关接口 ===========
+
+// Go 在管理器下跑一个任务，管理器关闭时取消 ctx 并等它跑完
+// ctx 结束也会取消任务，崩溃了通过 Logger 打日志，管理器已经关了返回的任务直接是 ErrorClosed
+func Go[T any](mgr *Mgr, ctx context.Context, f func(ctx context.Context) (T, error)) *Task[T] {
+	return goTask(mgr, ctx, f)
+}
+
+// Await 等任务的结果，超时返回 ErrorTimeout，之后还可以继续等
+// 任务返回错误为 ErrorTask，崩溃为 ErrorCrash
+func (t *Task[T]) Await(timeout time.Duration) (T, *Error) {
+	return t.await(timeout)
+}
+
+// Cancel 取消任务的 ctx，任务需要自己检查 ctx
+func (t *Task[T]) Cancel() {
+	t.cancel()
+}
+
+// Done 任务跑完了会关闭
+func (t *Task[T]) Done() <-chan struct{} {
+	return t.done
+}
+
+// =========== 协程池相关接口 ===========
+
+// NewPool 在 parent 下开一个名为 name 的协程池，size 个工作协程，每个都用 start 新建逻辑模块
+func NewPool(parent *Mgr, name string, size int, start func() SvrBehavior, opts ...PoolOption) (*Pool, *Error) {
+	return newPool(parent, name, size, start, opts)
+}
+
+// Pick 按分派方式挑一个工作协程，key 只在 DispatchHash 时有用
+func (p *Pool) Pick(key interface{}) (*Svr, *Error) {
+	return p.pick(key)
+}
+
+// Cast 分派给一个工作协程，不关心返回值，邮箱满了按工作协程的 Overflow 策略处理，默认会等
+func (p *Pool) Cast(key interface{}, msg Msg) *Error {
+	svr, err := p.pick(key)
+	if err != nil {
+		return err
+	}
+	return svr.push(context.Background(), msg, svr.opts.overflow)
+}
+
+// TryCast 同 Cast，但是不会等，邮箱满了直接返回 ErrorMailboxFull，同 Svr.TryCast
+func (p *Pool) TryCast(key interface{}, msg Msg) *Error {
+	svr, err := p.pick(key)
+	if err != nil {
+		return err
+	}
+	return svr.TryCast(msg)
+}
+
+// Call 分派给一个工作协程并等待返回
+func (p *Pool) Call(key interface{}, msg Msg, timeout time.Duration) (interface{}, *Error) {
+	svr, err := p.pick(key)
+	if err != nil {
+		return nil, err
+	}
+	return svr.call(msg, timeout)
+}
+
+// Checkout 借出一个工作协程独占使用，timeout 内都借出去了返回 ErrorTimeout，用完要 Checkin
+// DispatchHash 的池不能借，返回 ErrorPoolDispatch
+func (p *Pool) Checkout(timeout time.Duration) (*Svr, *Error) {
+	return p.checkout(timeout)
+}
+
+// Checkin 归还借出的工作协程
+func (p *Pool) Checkin(svr *Svr) *Error {
+	return p.checkin(svr)
+}
+
+// Mgr 协程池的管理器，关掉它就关掉整个池
+func (p *Pool) Mgr() *Mgr {
+	return p.mgr
+}
+
+// =========== 拦截器相关接口 ===========
+
+// Use 给管理器加拦截器，对管理器以及子管理器下之后启动的协程生效
+// 按顺序从外到里，上层管理器的在外面
+// 只拦逻辑模块的消息，Exec、停止之类框架自己的消息不经过拦截器
+func (mgr *Mgr) Use(interceptors ...Interceptor) {
+	mgr.use(interceptors)
+}
+
+// =========== 运行信息相关接口 ===========
+
+// Stats 协程运行信息
+func (svr *Svr) Stats() *SvrStats {
+	return svr.statsInfo()
+}
+
+// Stats 管理器运行信息，汇总了下面所有协程，不包括子管理器
+func (mgr *Mgr) Stats() *MgrStats {
+	return mgr.statsInfo(0)
+}
+
+// Tree 管理器以及所有子管理器的运行信息，每个管理器带上邮箱排队最多的 top 个协程
+func (mgr *Mgr) Tree(top int) *MgrStats {
+	return mgr.tree(top)
+}
+
+// DumpTree 从 RootMgr 开始的整个管理器树运行信息，json 格式
+func DumpTree(top int) ([]byte, error) {
+	return defaultRT.DumpTree(top)
 }
@@ -1,6 +1,7 @@
 package gen_routine
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
@@ -104,7 +105,7 @@ func TestMgr_NewSvr(t *testing.T) {
 }
 
 func BenchmarkMgr_NewSvr(b *testing.B) {
-	initRootMgr()
+	cleanEnv()
 	NewMgr(RootMgr(), "player mgr")
 	b.ResetTimer()
 	v, _ := LookupMgr(RootMgr(), "player mgr")
@@ -192,6 +193,15 @@ func TestJustRun(t *testing.T) {
 	time.Sleep(time.Second)
 	assert.Equal(t, b, 4)
 	assert.True(t, l.in)
+
+	// 不受管理器影响，根管理器关了也照样跑
+	initMgr(t)
+	assert.Nil(t, RootMgr().StopMgr(&Error{Code: ErrorNormalStop}))
+	ran := make(chan struct{})
+	JustRun(func() {
+		close(ran)
+	})
+	<-ran
 }
 
 type TestLogger struct {
@@ -227,18 +237,18 @@ func TestMgr_LookupSvr(t *testing.T) {
 func TestError_String(t *testing.T) {
 	svr, _ := initSvr(t)
 	crash, err := svr.CallInfinity("crash")
-	err.String()
+	_ = err.String()
 	assert.Nil(t, crash)
 	assert.NotNil(t, err)
 	time.Sleep(time.Second)
 	assert.Equal(t, svr.mgr.countSvr, int32(0))
 	err = &Error{Code: ErrorClosed, Last: err}
-	err.String()
+	_ = err.String()
 }
 
 // TestIntegration 协程管理的批量运行测试
 func TestIntegration(t *testing.T) {
-	initRootMgr()
+	cleanEnv()
 	w := sync.WaitGroup{}
 	const (
 		makeMgr = 1 + iota
@@ -317,12 +327,12 @@ func TestIntegration(t *testing.T) {
 	timeStart := time.Now()
 	fStat := func() {
 		c := int32(0)
-		mgrG.foreach(func(k interface{}, v interface{}) bool {
+		RootMgr().foreach(func(k interface{}, v interface{}) bool {
 			c = c + v.(*Mgr).countSvr
 			return true
 		})
 		t.Logf("%s stat info 已完成cast echo次数：%d echo cast 卡着的数量：%d 已完成call echo次数：%d echo call 卡着的数量：%d 管理器数量：%d 总的svr数量：%d",
-			time.Since(timeStart), statEchoCount, statWaitEcho, statCEchoCount, statCWaitEcho, mgrG.countMgr, c)
+			time.Since(timeStart), statEchoCount, statWaitEcho, statCEchoCount, statCWaitEcho, RootMgr().countMgr, c)
 	}
 
 	go func() {
@@ -345,6 +355,9 @@ type svrBehavior struct {
 	terminated bool
 
 	execRecord map[string]string
+	recv       chan Msg // 不为nil 则未知消息都转发到这里
+	block      chan struct{}
+	onTerm     func(reason *Error)
 }
 
 const (
@@ -371,8 +384,15 @@ func (s *svrBehavior) HandleMsg(msg Msg) (interface{}, *Error) {
 			return v, nil
 		case "crash":
 			panic("test crash")
+		case "block":
+			<-s.block
+			return v, nil
 		}
 	}
+	if s.recv != nil {
+		s.recv <- msg
+		return nil, nil
+	}
 	fmt.Printf("received unknow msg %v\n", msg)
 	return nil, nil
 }
@@ -389,6 +409,9 @@ func (s *svrBehavior) Init(svr *Svr) *Error {
 
 func (s *svrBehavior) Terminate(reason *Error) {
 	s.terminated = true
+	if s.onTerm != nil {
+		s.onTerm(reason)
+	}
 	if reason.Code == ErrorCrash {
 		panic("test terminate crash")
 	}
@@ -420,16 +443,18 @@ func execSomeArgsSomeRet(in1 string, in2 int32, in3 []bool) (string, error, int)
 }
 
 func TestSvr_Grp(t *testing.T) {
-	initGrp()
+	cleanEnv()
 	// 直接拉空的出来
 	assert.Equal(t, 0, len(GrpAll("")))
 
 	svr, _ := initSvr(t)
+	grp := defaultRT.grp
 	grpKey := "test grp"
 	svr.GrpReg(grpKey)
 	svr.GrpReg(grpKey)
-	assert.Equal(t, grp.svrGrp[grpKey][svr.key], svr)
-	assert.Equal(t, grp.svrKey[svr.key][grpKey], true)
+	assert.True(t, grp.has(grpKey, svr))
+	assert.Equal(t, svr.grps[grpKey], true)
+	assert.Equal(t, 1, GrpCount(grpKey))
 
 	svr1, _ := svr.mgr.NewSvr(nil, &svrBehavior{})
 	// 俩 svr 的 key 不一样
@@ -441,11 +466,12 @@ func TestSvr_Grp(t *testing.T) {
 	// 同一组里，俩 svr 都在
 	assert.Equal(t, []*Svr{svr, svr1}, all)
 
+	assert.Equal(t, 2, GrpCount(grpKey))
+
 	svr.GrpByeBye()
-	// 两个map里都清理掉了
-	_, ok := grp.svrGrp[grpKey][svr.key]
-	assert.False(t, ok)
-	_, ok = grp.svrGrp[svr.key]
+	// 两边都清理掉了
+	assert.False(t, grp.has(grpKey, svr))
+	_, ok := svr.grps[grpKey]
 	assert.False(t, ok)
 
 	// 全部里面只有1个
@@ -454,10 +480,11 @@ func TestSvr_Grp(t *testing.T) {
 
 	svr1.GrpUnReq(grpKey)
 	// 都没了
-	_, ok = grp.svrGrp[grpKey]
+	_, ok = grp.shard(grpKey).grps[grpKey]
 	assert.False(t, ok)
-	_, ok = grp.svrKey[svr1.key]
+	_, ok = svr1.grps[grpKey]
 	assert.False(t, ok)
+	assert.Equal(t, 0, GrpCount(grpKey))
 
 	// 删除不存在的
 	svr.GrpUnReq(grpKey)
@@ -467,6 +494,85 @@ func TestSvr_Grp(t *testing.T) {
 	// 走bye清理完所有的，清理grpKey
 	svr.GrpReg(grpKey)
 	svr.GrpByeBye()
+	_, ok = grp.shard(grpKey).grps[grpKey]
+	assert.False(t, ok)
+
+	// 不同管理器里 key 相同的 svr 不会互相覆盖
+	mgr1, _ := NewMgr(RootMgr(), "other mgr")
+	svr2, _ := mgr1.NewSvr(svr1.key, &svrBehavior{})
+	svr1.GrpReg(grpKey)
+	svr2.GrpReg(grpKey)
+	assert.Equal(t, 2, GrpCount(grpKey))
+}
+
+func TestSvr_GrpConcurrent(t *testing.T) {
+	svr, _ := initSvr(t)
+	var svrs []*Svr
+	for i := 0; i < 16; i++ {
+		s, _ := svr.mgr.NewSvr(nil, &svrBehavior{})
+		svrs = append(svrs, s)
+	}
+	w := sync.WaitGroup{}
+	for _, s := range svrs {
+		w.Add(1)
+		go func(s *Svr) {
+			defer w.Done()
+			for i := 0; i < 100; i++ {
+				s.GrpReg(i % 10)
+				GrpAll(i % 10)
+				GrpCount(i % 10)
+				if i%3 == 0 {
+					s.GrpUnReq(i % 10)
+				}
+			}
+			s.GrpByeBye()
+		}(s)
+	}
+	w.Wait()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 0, GrpCount(i))
+		assert.Nil(t, GrpAll(i))
+	}
+}
+
+// BenchmarkGrp_JoinLeave 大量聊天室并发进出
+func BenchmarkGrp_JoinLeave(b *testing.B) {
+	cleanEnv()
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		svr, _ := RootMgr().NewSvr(nil, &svrBehavior{})
+		i := int(atomic.AddInt64(&n, 1)) * 100000
+		for pb.Next() {
+			i++
+			svr.GrpReg(i % 4096)
+			svr.GrpUnReq(i % 4096)
+		}
+	})
+}
+
+// BenchmarkGrp_HotRoom 同一个聊天室并发进出以及拉成员
+func BenchmarkGrp_HotRoom(b *testing.B) {
+	cleanEnv()
+	for i := 0; i < 1000; i++ {
+		s, _ := RootMgr().NewSvr(nil, &svrBehavior{})
+		s.GrpReg("hot")
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		svr, _ := RootMgr().NewSvr(nil, &svrBehavior{})
+		i := 0
+		for pb.Next() {
+			i++
+			switch i % 4 {
+			case 0:
+				svr.GrpReg("hot")
+			case 1:
+				svr.GrpUnReq("hot")
+			default:
+				defaultRT.grp.snapshot("hot")
+			}
+		}
+	})
 }
 
 func TestSvr_Exec(t *testing.T) {
@@ -533,3 +639,1685 @@ func initSvr(t *testing.T) (*Svr, *Error) {
 func cleanEnv() {
 	BeforeMain()
 }
+
+// waitTrue 轮询等待条件成立
+func waitTrue(t *testing.T, f func() bool) {
+	for i := 0; i < 200; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("wait condition timeout")
+}
+
+func lookupSvr(mgr *Mgr, k interface{}) *Svr {
+	v, ok := mgr.LookupSvr(k)
+	if !ok {
+		return nil
+	}
+	return v.(*Svr)
+}
+
+func newTestSpec(k interface{}, restart RestartType) ChildSpec {
+	return ChildSpec{
+		Key:     k,
+		Restart: restart,
+		Start: func() SvrBehavior {
+			return &svrBehavior{execRecord: map[string]string{}}
+		},
+	}
+}
+
+func TestMgr_SupOneForOne(t *testing.T) {
+	initMgr(t)
+	mgr, err := NewSupMgr(RootMgr(), "sup mgr", SupFlags{Strategy: OneForOne, Intensity: 10, Period: time.Second})
+	assert.Nil(t, err)
+	plain, _ := NewMgr(RootMgr(), "plain mgr")
+	_, err = plain.StartChild(newTestSpec(nil, Permanent))
+	assert.Equal(t, ErrorNotSupervisor, err.Code)
+
+	p, err := mgr.StartChild(newTestSpec("permanent", Permanent))
+	assert.Nil(t, err)
+	tr, _ := mgr.StartChild(newTestSpec("transient", Transient))
+	tmp, _ := mgr.StartChild(newTestSpec("temporary", Temporary))
+	_, err = mgr.StartChild(newTestSpec("permanent", Permanent))
+	assert.Equal(t, ErrorAlreadyHad, err.Code)
+
+	// 崩溃后同一个key 重新拉起来
+	p.Cast("crash")
+	waitTrue(t, func() bool {
+		s := lookupSvr(mgr, "permanent")
+		return s != nil && s != p
+	})
+	// 正常退出也重启
+	p = lookupSvr(mgr, "permanent")
+	p.StopSvr(&Error{Code: ErrorNormalStop})
+	waitTrue(t, func() bool {
+		s := lookupSvr(mgr, "permanent")
+		return s != nil && s != p
+	})
+
+	// transient 崩溃重启，正常退出不重启
+	tr.Cast("crash")
+	waitTrue(t, func() bool {
+		s := lookupSvr(mgr, "transient")
+		return s != nil && s != tr
+	})
+	tr = lookupSvr(mgr, "transient")
+	tr.StopSvr(&Error{Code: ErrorNormalStop})
+	<-tr.done
+	time.Sleep(time.Millisecond * 100)
+	assert.Nil(t, lookupSvr(mgr, "transient"))
+
+	// temporary 从不重启
+	tmp.Cast("crash")
+	<-tmp.done
+	time.Sleep(time.Millisecond * 100)
+	assert.Nil(t, lookupSvr(mgr, "temporary"))
+
+	p = lookupSvr(mgr, "permanent")
+	assert.Nil(t, mgr.TerminateChild("permanent", &Error{Code: ErrorNormalStop}))
+	assert.True(t, p.mod.(*svrBehavior).terminated)
+	assert.Nil(t, lookupSvr(mgr, "permanent"))
+	assert.Equal(t, ErrorNotFind, mgr.TerminateChild("permanent", nil).Code)
+
+	// 自己关自己不会卡住，之后同一个 key 还能再开
+	self, _ := mgr.StartChild(newTestSpec("self", Permanent))
+	var selfErr *Error
+	assert.Nil(t, Exec(self, func(s *svrBehavior) {
+		selfErr = mgr.TerminateChild("self", &Error{Code: ErrorNormalStop})
+	}))
+	<-self.done
+	assert.Equal(t, ErrorDeadlock, selfErr.Code)
+	time.Sleep(time.Millisecond * 50)
+	assert.Nil(t, lookupSvr(mgr, "self"))
+	_, err = mgr.StartChild(newTestSpec("self", Permanent))
+	assert.Nil(t, err)
+}
+
+func TestMgr_SupOneForAll(t *testing.T) {
+	initMgr(t)
+	mgr, _ := NewSupMgr(RootMgr(), "sup mgr", SupFlags{Strategy: OneForAll, Intensity: 10, Period: time.Second})
+	a, _ := mgr.StartChild(newTestSpec("a", Permanent))
+	b, _ := mgr.StartChild(newTestSpec("b", Permanent))
+	c, _ := mgr.StartChild(newTestSpec("c", Permanent))
+	b.Cast("crash")
+	waitTrue(t, func() bool {
+		na, nb, nc := lookupSvr(mgr, "a"), lookupSvr(mgr, "b"), lookupSvr(mgr, "c")
+		return na != nil && nb != nil && nc != nil && na != a && nb != b && nc != c
+	})
+	assert.True(t, a.mod.(*svrBehavior).terminated)
+	assert.True(t, c.mod.(*svrBehavior).terminated)
+	assert.Equal(t, int32(3), mgr.countSvr)
+}
+
+func TestMgr_SupRestForOne(t *testing.T) {
+	initMgr(t)
+	mgr, _ := NewSupMgr(RootMgr(), "sup mgr", SupFlags{Strategy: RestForOne, Intensity: 10, Period: time.Second})
+	a, _ := mgr.StartChild(newTestSpec("a", Permanent))
+	b, _ := mgr.StartChild(newTestSpec("b", Permanent))
+	c, _ := mgr.StartChild(newTestSpec("c", Permanent))
+	b.Cast("crash")
+	waitTrue(t, func() bool {
+		nb, nc := lookupSvr(mgr, "b"), lookupSvr(mgr, "c")
+		return nb != nil && nc != nil && nb != b && nc != c
+	})
+	// 在它之前启动的不受影响
+	assert.Equal(t, a, lookupSvr(mgr, "a"))
+	assert.False(t, a.mod.(*svrBehavior).terminated)
+}
+
+func TestMgr_SupIntensity(t *testing.T) {
+	initMgr(t)
+	mgr, _ := NewSupMgr(RootMgr(), "sup mgr", SupFlags{Strategy: OneForOne, Intensity: 2, Period: time.Minute})
+	mgr.StartChild(newTestSpec("a", Permanent))
+	for i := 0; i < 3; i++ {
+		s := lookupSvr(mgr, "a")
+		if s == nil {
+			break
+		}
+		s.Cast("crash")
+		<-s.done
+		if i < 2 {
+			waitTrue(t, func() bool {
+				n := lookupSvr(mgr, "a")
+				return n != nil && n != s
+			})
+		}
+	}
+	// 超过重启频率，整个管理器退出
+	waitTrue(t, func() bool {
+		_, ok := LookupMgr(RootMgr(), "sup mgr")
+		return !ok
+	})
+	assert.Nil(t, lookupSvr(mgr, "a"))
+}
+
+// 第一次之后初始化都失败
+type failInitBehavior struct {
+	svrBehavior
+	fail bool
+}
+
+func (s *failInitBehavior) Init(svr *Svr) *Error {
+	if s.fail {
+		return &Error{Code: ErrorCrash, Param: "init fail"}
+	}
+	return nil
+}
+
+func TestMgr_SupRestartFail(t *testing.T) {
+	initMgr(t)
+	mgr, _ := NewSupMgr(RootMgr(), "sup mgr", SupFlags{Strategy: OneForOne, Intensity: 10, Period: time.Minute})
+	var started int32
+	a, err := mgr.StartChild(ChildSpec{Key: "a", Restart: Permanent, Start: func() SvrBehavior {
+		return &failInitBehavior{fail: atomic.AddInt32(&started, 1) > 1}
+	}})
+	assert.Nil(t, err)
+	a.Cast("crash")
+	// 重启失败，整个管理器退出
+	<-mgr.stopped
+	assert.Equal(t, ErrorRestartLimit, mgr.stopReason.Code)
+	assert.Equal(t, ErrorRoutineInitFail, mgr.stopReason.Last.Code)
+	_, ok := LookupMgr(RootMgr(), "sup mgr")
+	assert.False(t, ok)
+}
+
+func newRecvSvr(t *testing.T, mgr *Mgr) (*Svr, chan Msg) {
+	recv := make(chan Msg, 16)
+	svr, err := mgr.NewSvr(nil, &svrBehavior{execRecord: map[string]string{}, recv: recv})
+	assert.Nil(t, err)
+	return svr, recv
+}
+
+func TestSvr_Monitor(t *testing.T) {
+	target, _ := initSvr(t)
+	watcher, recv := newRecvSvr(t, target.mgr)
+	ref := watcher.Monitor(target)
+	ref1 := watcher.Monitor(target)
+	watcher.Demonitor(ref1)
+	target.Cast("crash")
+	down := (<-recv).(*MsgDown)
+	assert.Equal(t, ref, down.Ref)
+	assert.Equal(t, target, down.Svr)
+	assert.Equal(t, ErrorCrash, down.Reason.Code)
+	select {
+	case m := <-recv:
+		t.Fatalf("demonitor still received %v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// 监控已经退出的协程，直接收到
+	ref = watcher.Monitor(target)
+	down = (<-recv).(*MsgDown)
+	assert.Equal(t, ref, down.Ref)
+	assert.Equal(t, ErrorClosed, down.Reason.Code)
+}
+
+func TestSvr_Link(t *testing.T) {
+	a, _ := initSvr(t)
+	b, _ := a.mgr.NewSvr(nil, &svrBehavior{})
+	c, _ := a.mgr.NewSvr(nil, &svrBehavior{})
+	assert.Nil(t, a.Link(b))
+	assert.Nil(t, a.Link(c))
+	a.Unlink(c)
+	// 非正常退出，链接的一起退出
+	a.Cast("crash")
+	<-b.done
+	assert.True(t, b.mod.(*svrBehavior).terminated)
+	time.Sleep(time.Millisecond * 100)
+	assert.False(t, c.mod.(*svrBehavior).terminated)
+	assert.Equal(t, ErrorClosed, c.Link(a).Code)
+
+	// 正常退出不影响
+	d, _ := a.mgr.NewSvr(nil, &svrBehavior{})
+	c.Link(d)
+	d.StopSvr(&Error{Code: ErrorNormalStop})
+	<-d.done
+	time.Sleep(time.Millisecond * 100)
+	assert.False(t, c.mod.(*svrBehavior).terminated)
+
+	// trap exit 收到消息
+	e, recv := newRecvSvr(t, a.mgr)
+	e.TrapExit(true)
+	e.Link(c)
+	c.Cast("crash")
+	exit := (<-recv).(*MsgExit)
+	assert.Equal(t, c, exit.Svr)
+	assert.Equal(t, ErrorCrash, exit.Reason.Code)
+	assert.False(t, e.mod.(*svrBehavior).terminated)
+}
+
+func TestSvr_Timer(t *testing.T) {
+	base, _ := initSvr(t)
+	svr, recv := newRecvSvr(t, base.mgr)
+	svr.SendAfter(time.Millisecond*10, "after")
+	assert.Equal(t, "after", <-recv)
+
+	tm := svr.SendAfter(time.Hour, "never")
+	assert.True(t, tm.Cancel())
+	assert.False(t, tm.Cancel())
+
+	tick := svr.Tick(time.Millisecond*10, "tick")
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "tick", <-recv)
+	}
+	assert.True(t, tick.Cancel())
+	time.Sleep(time.Millisecond * 30)
+	for len(recv) > 0 {
+		<-recv
+	}
+	time.Sleep(time.Millisecond * 30)
+	assert.Equal(t, 0, len(recv))
+
+	// 协程退出后自动清理
+	tick = svr.Tick(time.Millisecond*10, "tick")
+	svr.StopSvr(&Error{Code: ErrorNormalStop})
+	<-svr.done
+	assert.False(t, tick.Cancel())
+	assert.Nil(t, svr.timers)
+	assert.False(t, svr.SendAfter(time.Millisecond, "closed").Cancel())
+}
+
+// newBlockSvr 开一个卡在处理消息中的协程，邮箱容量为2
+func newBlockSvr(t *testing.T, opts ...SvrOption) (*Svr, chan Msg, chan struct{}) {
+	base, _ := initSvr(t)
+	recv := make(chan Msg, 16)
+	block := make(chan struct{})
+	opts = append([]SvrOption{WithMailbox(2)}, opts...)
+	svr, err := base.mgr.NewSvr(nil, &svrBehavior{recv: recv, block: block}, opts...)
+	assert.Nil(t, err)
+	svr.Cast("block")
+	waitTrue(t, func() bool { return len(svr.receive) == 0 })
+	return svr, recv, block
+}
+
+func TestSvr_Overflow(t *testing.T) {
+	// 默认阻塞，TryCast 不等
+	svr, _, block := newBlockSvr(t)
+	assert.Equal(t, 2, cap(svr.receive))
+	assert.Nil(t, svr.TryCast(1))
+	assert.Nil(t, svr.TryCast(2))
+	assert.Equal(t, ErrorMailboxFull, svr.TryCast(3).Code)
+	_, err := svr.Call(4, time.Millisecond*10)
+	assert.Equal(t, ErrorTimeout, err.Code)
+	close(block)
+
+	// 丢掉新的
+	svr, recv, block := newBlockSvr(t, WithOverflow(OverflowDropNewest, 0))
+	for i := 1; i <= 4; i++ {
+		svr.Cast(i)
+	}
+	assert.Nil(t, svr.TryCast(5))
+	assert.Equal(t, uint64(3), svr.dropped)
+	// 调用不会被丢掉，直接返回邮箱满了
+	_, err = svr.CallInfinity(6)
+	assert.Equal(t, ErrorMailboxFull, err.Code)
+	close(block)
+	assert.Equal(t, 1, <-recv)
+	assert.Equal(t, 2, <-recv)
+
+	// 丢掉老的
+	svr, recv, block = newBlockSvr(t, WithOverflow(OverflowDropOldest, 0))
+	for i := 1; i <= 4; i++ {
+		svr.Cast(i)
+	}
+	assert.Equal(t, uint64(2), svr.dropped)
+	// 被挤掉的调用收到邮箱满了
+	callRet := make(chan *Error, 1)
+	go func() {
+		_, err := svr.CallInfinity(5)
+		callRet <- err
+	}()
+	waitTrue(t, func() bool { return atomic.LoadUint64(&svr.dropped) == 3 })
+	svr.Cast(6)
+	svr.Cast(7)
+	assert.Equal(t, ErrorMailboxFull, (<-callRet).Code)
+	assert.Equal(t, uint64(5), atomic.LoadUint64(&svr.dropped))
+	close(block)
+	assert.Equal(t, 6, <-recv)
+	assert.Equal(t, 7, <-recv)
+
+	// 返回错误
+	svr, _, block = newBlockSvr(t, WithOverflow(OverflowError, 0))
+	svr.Cast(1)
+	svr.Cast(2)
+	assert.Equal(t, ErrorMailboxFull, svr.TryCast(3).Code)
+	close(block)
+
+	// 等一段时间
+	svr, _, block = newBlockSvr(t, WithOverflow(OverflowBlockTimeout, time.Millisecond*10))
+	svr.Cast(1)
+	svr.Cast(2)
+	assert.Equal(t, ErrorTimeout, svr.TryCast(3).Code)
+	close(block)
+}
+
+func TestSvr_Closed(t *testing.T) {
+	svr, _ := initSvr(t)
+	svr.StopSvr(&Error{Code: ErrorNormalStop})
+	<-svr.done
+	// 退出后都不会卡住
+	for i := 0; i < receiveChanLen*2; i++ {
+		svr.Cast("echo")
+	}
+	svr.StopSvr(&Error{Code: ErrorNormalStop})
+	assert.Equal(t, ErrorClosed, svr.TryCast("echo").Code)
+	_, err := svr.CallInfinity("call_echo")
+	assert.Equal(t, ErrorClosed, err.Code)
+}
+
+type otherBehavior struct {
+	svrBehavior
+}
+
+func TestSvr_ExecTyped(t *testing.T) {
+	svr, _ := initSvr(t)
+	mod := svr.mod.(*svrBehavior)
+	assert.Nil(t, Exec(svr, func(s *svrBehavior) {
+		s.execRecord["Exec"] = "invoked"
+	}))
+	ret, err := CallFn(svr, func(s *svrBehavior) string {
+		return s.execRecord["Exec"]
+	}, Infinity)
+	assert.Nil(t, err)
+	assert.Equal(t, "invoked", ret)
+	assert.Equal(t, "invoked", mod.execRecord["Exec"])
+
+	// 返回 interface 类型的 nil 值
+	retE, err := CallFn(svr, func(s *svrBehavior) error { return nil }, Infinity)
+	assert.Nil(t, err)
+	assert.Nil(t, retE)
+
+	// 逻辑模块类型不对
+	err = Exec(svr, func(s *otherBehavior) {})
+	assert.Equal(t, ErrorModType, err.Code)
+	_, err = CallFn(svr, func(s *otherBehavior) int { return 1 }, Infinity)
+	assert.Equal(t, ErrorModType, err.Code)
+
+	// 超时
+	_, err = CallFn(svr, func(s *svrBehavior) int {
+		time.Sleep(time.Millisecond * 100)
+		return 1
+	}, time.Millisecond)
+	assert.Equal(t, ErrorTimeout, err.Code)
+	ret1, err := svr.SyncExec(func() { time.Sleep(time.Millisecond * 100) }, time.Millisecond)
+	assert.Equal(t, ErrorTimeout, err.Code)
+	assert.Nil(t, ret1)
+
+	// 反射调用参数类型不对
+	err = svr.ASyncExec(mod.ExecOneArgsOneRet, 1)
+	assert.Equal(t, ErrorReflectParamsType, err.Code)
+	_, err = svr.SyncExec(mod.ExecSomeArgsSomeRet, Infinity, nil, nil)
+	assert.Equal(t, ErrorReflectParamsType, err.Code)
+	ret1, err = svr.SyncExec(mod.ExecSomeArgsSomeRet, Infinity, "in1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "in1[]", mod.execRecord["ExecSomeArgsSomeRet"])
+}
+
+func TestTypedMgr(t *testing.T) {
+	cleanEnv()
+	t.Cleanup(cleanEnv)
+	mgr, err := NewTypedMgr[string, *svrBehavior](RootMgr(), "typed mgr")
+	assert.Nil(t, err)
+	mod := &svrBehavior{}
+	ret, err := mgr.NewSvr("a", mod)
+	assert.Nil(t, err)
+	assert.Equal(t, mod, ret)
+	ret, err = mgr.NewSvr("a", &svrBehavior{})
+	assert.Equal(t, ErrorAlreadyHad, err.Code)
+	assert.Equal(t, mod, ret)
+	ret, err = mgr.NewSvr("init err", &svrBehavior{})
+	assert.NotNil(t, err)
+	assert.Nil(t, ret)
+
+	ret, ok := mgr.Lookup("a")
+	assert.True(t, ok)
+	assert.Equal(t, mod, ret)
+	_, ok = mgr.Lookup("b")
+	assert.False(t, ok)
+	// 通过里面的 *Mgr 开的别的类型查不到，也不会崩
+	_, err = mgr.Mgr.NewSvr("other", &idleBehavior{})
+	assert.Nil(t, err)
+	_, ok = mgr.Lookup("other")
+	assert.False(t, ok)
+	_, err = mgr.NewSvr("other", &svrBehavior{})
+	assert.Equal(t, ErrorModType, err.Code)
+	assert.Equal(t, ErrorAlreadyHad, err.Last.Code)
+	i := 0
+	mgr.Foreach(func(k string, m *svrBehavior) bool {
+		assert.Equal(t, "a", k)
+		assert.Equal(t, mod, m)
+		i++
+		return true
+	})
+	assert.Equal(t, 1, i)
+}
+
+func BenchmarkSvr_SyncExec(b *testing.B) {
+	cleanEnv()
+	svr, _ := RootMgr().NewSvr(nil, &svrBehavior{execRecord: map[string]string{}})
+	mod := svr.mod.(*svrBehavior)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		svr.SyncExec(mod.ExecOneArgsOneRet, Infinity, "in")
+	}
+}
+
+func BenchmarkSvr_CallFn(b *testing.B) {
+	cleanEnv()
+	svr, _ := RootMgr().NewSvr(nil, &svrBehavior{execRecord: map[string]string{}})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		CallFn(svr, func(s *svrBehavior) string { return s.ExecOneArgsOneRet("in") }, Infinity)
+	}
+}
+
+type ctxKey struct{}
+
+func TestSvr_CallCtx(t *testing.T) {
+	svr, _, block := newBlockSvr(t)
+	// 调用者取消，不用等处理方
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		cancel()
+	}()
+	_, err := svr.CallCtx(ctx, "call_echo")
+	assert.Equal(t, ErrorCtxDone, err.Code)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err = svr.SyncExecCtx(ctx, execNoArgsNoRet)
+	assert.Equal(t, ErrorTimeout, err.Code)
+	close(block)
+
+	// 处理方不会被卡住，已经放弃的调用直接丢掉
+	ret, err := svr.Call("call_echo", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "call_echo", ret)
+
+	// 处理方能拿到调用者的 ctx
+	ctx = context.WithValue(context.Background(), ctxKey{}, "caller")
+	retA, err := svr.SyncExecCtx(ctx, func() interface{} {
+		return svr.CallContext().Value(ctxKey{})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "caller", retA[0])
+	hasDeadline, err := CallFn(svr, func(s *svrBehavior) bool {
+		_, ok := svr.CallContext().Deadline()
+		return ok
+	}, time.Second)
+	assert.Nil(t, err)
+	assert.True(t, hasDeadline)
+	assert.Equal(t, context.Background(), svr.CallContext())
+}
+
+func TestMgr_StopMgrOrder(t *testing.T) {
+	initMgr(t)
+	parent, _ := NewMgr(RootMgr(), "parent")
+	var order []string
+	var mux sync.Mutex
+	newSvr := func(mgr *Mgr, name string) {
+		_, err := mgr.NewSvr(name, &svrBehavior{onTerm: func(reason *Error) {
+			mux.Lock()
+			defer mux.Unlock()
+			order = append(order, fmt.Sprintf("%s %d", name, reason.Code))
+		}})
+		assert.Nil(t, err)
+	}
+	a, _ := NewMgr(parent, "a")
+	b, _ := NewMgr(parent, "b")
+	a1, _ := NewMgr(a, "a1")
+	newSvr(parent, "parent svr")
+	newSvr(a, "a svr")
+	newSvr(b, "b svr")
+	newSvr(a1, "a1 svr")
+	assert.Nil(t, parent.StopMgr(&Error{Code: ErrorNormalStop}))
+	// 子管理器按创建的反序，先关子的再关自己的
+	assert.Equal(t, []string{"b svr -4", "a1 svr -4", "a svr -4", "parent svr -4"}, order)
+	_, ok := LookupMgr(RootMgr(), "parent")
+	assert.False(t, ok)
+	_, ok = LookupMgr(parent, "a")
+	assert.False(t, ok)
+	assert.Equal(t, int32(0), parent.countMgr)
+	// 重复关闭没问题
+	assert.Nil(t, parent.StopMgr(nil))
+}
+
+func TestMgr_StopMgrDrain(t *testing.T) {
+	svr, recv, block := newBlockSvr(t, WithMailbox(8))
+	var term *Error
+	svr.mod.(*svrBehavior).onTerm = func(reason *Error) {
+		term = reason
+	}
+	for i := 0; i < 3; i++ {
+		svr.Cast(i)
+	}
+	go func() {
+		waitTrue(t, svr.mgr.isStopping)
+		// 排空的时候不能再开新的协程
+		_, err := svr.mgr.NewSvr(nil, &svrBehavior{})
+		assert.Equal(t, ErrorClosed, err.Code)
+		close(block)
+	}()
+	assert.Nil(t, svr.mgr.StopMgr(&Error{Code: ErrorNormalStop}, WithDrain(), WithDeadline(time.Second)))
+	// 排队的消息都处理了
+	assert.Equal(t, 3, len(recv))
+	assert.Equal(t, ErrorNormalStop, term.Code)
+
+	// 监督者关闭时也不能再启动子协程
+	mgr, _ := NewSupMgr(RootMgr(), "sup drain", SupFlags{})
+	block = make(chan struct{})
+	child, err := mgr.StartChild(ChildSpec{Start: func() SvrBehavior { return &svrBehavior{block: block} }})
+	assert.Nil(t, err)
+	child.Cast("block")
+	go func() {
+		waitTrue(t, mgr.isStopping)
+		_, err := mgr.StartChild(newTestSpec("late", Permanent))
+		assert.Equal(t, ErrorClosed, err.Code)
+		close(block)
+	}()
+	assert.Nil(t, mgr.StopMgr(&Error{Code: ErrorNormalStop}, WithDrain(), WithDeadline(time.Second)))
+}
+
+func TestMgr_StopMgrDeadline(t *testing.T) {
+	svr, _, block := newBlockSvr(t)
+	defer close(block)
+	start := time.Now()
+	err := svr.mgr.StopMgr(&Error{Code: ErrorNormalStop}, WithDrain(), WithDeadline(time.Millisecond*50))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, ErrorTimeout, err.Code)
+	// 报告卡住的协程以及堆栈
+	assert.Contains(t, err.Param, fmt.Sprintf("svr %v stuck", svr.key))
+	assert.Contains(t, err.Param, "HandleMsg")
+
+	svr, _, block1 := newBlockSvr(t)
+	defer close(block1)
+	// 同时关的拿到同样的结果
+	second := make(chan *Error, 1)
+	go func() {
+		waitTrue(t, svr.mgr.isStopping)
+		second <- svr.mgr.StopMgr(nil)
+	}()
+	err = svr.mgr.StopMgr(nil, WithDeadline(time.Millisecond*50))
+	assert.Equal(t, ErrorTimeout, err.Code)
+	assert.Contains(t, err.Param, "HandleMsg")
+	assert.Equal(t, err, <-second)
+
+	// 子管理器超时，父管理器包一层返回，不改子管理器的结果
+	parent, _ := NewMgr(RootMgr(), "deadline parent")
+	child, _ := NewMgr(parent, "deadline child")
+	stuck, _ := child.NewSvr(nil, &svrBehavior{block: block})
+	stuck.Cast("block")
+	err = parent.StopMgr(&Error{Code: ErrorNormalStop}, WithDeadline(time.Millisecond*50))
+	assert.Equal(t, ErrorTimeout, err.Code)
+	assert.Contains(t, err.String(), "child mgr deadline child")
+	assert.Nil(t, child.stopRet.Last)
+	assert.Equal(t, child.stopRet, child.StopMgr(nil))
+}
+
+func TestMgr_StopMgrFromTerminate(t *testing.T) {
+	initMgr(t)
+	// 协程崩了，Terminate 里关自己的管理器
+	mgr, _ := NewMgr(RootMgr(), "stop from terminate")
+	inTerm := make(chan *Error, 2)
+	onTerm := func(reason *Error) {
+		inTerm <- mgr.StopMgr(&Error{Code: ErrorNormalStop})
+	}
+	svr, _ := mgr.NewSvr(nil, &svrBehavior{onTerm: onTerm})
+	other, _ := mgr.NewSvr(nil, &svrBehavior{})
+	svr.Cast("crash")
+	assert.Equal(t, ErrorDeadlock, (<-inTerm).Code)
+	<-mgr.stopped
+	<-other.done
+
+	// 管理器正在关，Terminate 里再关一次也不会卡住
+	mgr, _ = NewMgr(RootMgr(), "stop again from terminate")
+	mgr.NewSvr(nil, &svrBehavior{onTerm: onTerm})
+	assert.Nil(t, mgr.StopMgr(&Error{Code: ErrorNormalStop}, WithDeadline(time.Second)))
+	assert.Equal(t, ErrorDeadlock, (<-inTerm).Code)
+}
+
+func TestSvr_Deadlock(t *testing.T) {
+	a, _ := initSvr(t)
+	b, _ := a.mgr.NewSvr("b", &svrBehavior{})
+	// 自己调自己
+	err, _ := CallFn(a, func(s *svrBehavior) *Error {
+		_, err := a.CallInfinity("call_echo")
+		return err
+	}, time.Second)
+	assert.Equal(t, ErrorDeadlock, err.Code)
+	assert.Contains(t, err.Param, fmt.Sprintf("player mgr/%v -> player mgr/%v", a.key, a.key))
+
+	// A -> B -> A
+	err, _ = CallFn(a, func(s *svrBehavior) *Error {
+		inner, callErr := CallFn(b, func(s *svrBehavior) *Error {
+			_, e := a.SyncExec(func() {}, time.Second)
+			return e
+		}, time.Second)
+		if callErr != nil {
+			return callErr
+		}
+		return inner
+	}, time.Second)
+	// 哪一方先检测到都有可能
+	assert.Equal(t, ErrorDeadlock, err.Code)
+	assert.Contains(t, err.Param, "player mgr/b")
+	assert.Contains(t, err.Param, fmt.Sprintf("player mgr/%v", a.key))
+
+	// 调用结束后清理干净，正常的调用链不受影响
+	waitTrue(t, func() bool {
+		calls := a.mgr.rt.calls
+		calls.mux.Lock()
+		defer calls.mux.Unlock()
+		return len(calls.waiting) == 0
+	})
+	ret, err := CallFn(a, func(s *svrBehavior) interface{} {
+		ret, _ := b.CallInfinity("call_echo")
+		return ret
+	}, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "call_echo", ret)
+}
+
+func TestMgr_Stats(t *testing.T) {
+	svr, recv, block := newBlockSvr(t, WithMailbox(8))
+	svr.Cast("echo")
+	svr.Cast(1)
+	st := svr.Stats()
+	assert.Equal(t, fmt.Sprintf("%v", svr.key), st.Key)
+	assert.Equal(t, 2, st.Mailbox)
+	assert.Equal(t, 8, st.Capacity)
+	time.Sleep(time.Millisecond * 20)
+	close(block)
+	<-recv
+	waitTrue(t, func() bool { return svr.Stats().Handled == 3 })
+	st = svr.Stats()
+	assert.Equal(t, "int", st.LastMsg)
+	// block 卡了一段时间
+	assert.True(t, st.P99 >= 16384)
+	assert.True(t, st.P99 >= st.P50)
+
+	other, _ := svr.mgr.NewSvr(nil, &svrBehavior{})
+	other.CallInfinity("call_echo")
+	assert.Equal(t, "string", other.Stats().LastMsg)
+	other.Cast("crash")
+	<-other.done
+
+	mst := svr.mgr.Stats()
+	assert.Equal(t, "player mgr", mst.Name)
+	assert.Equal(t, int32(2), mst.CountSvr)
+	assert.Equal(t, uint64(1), mst.Crashes)
+	assert.Nil(t, mst.Svrs)
+
+	NewMgr(svr.mgr, "sub mgr")
+	tree := RootMgr().Tree(1)
+	assert.Equal(t, "global", tree.Name)
+	assert.Equal(t, "player mgr", tree.Children[0].Name)
+	assert.Equal(t, 1, len(tree.Children[0].Svrs))
+	assert.Equal(t, "sub mgr", tree.Children[0].Children[0].Name)
+
+	data, err := DumpTree(3)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"name":"sub mgr"`)
+}
+
+func TestHistogram(t *testing.T) {
+	h := &histogram{}
+	assert.Equal(t, time.Duration(0), h.percentile(0.5))
+	for i := 0; i < 98; i++ {
+		h.observe(time.Microsecond * 3)
+	}
+	h.observe(time.Millisecond * 10)
+	h.observe(time.Hour)
+	assert.Equal(t, time.Microsecond*4, h.percentile(0.5))
+	assert.Equal(t, time.Microsecond*16384, h.percentile(0.99))
+	assert.Equal(t, time.Microsecond<<(latencyBuckets-1), h.percentile(1))
+}
+
+type idleBehavior struct {
+	svrBehavior
+	idle int32
+}
+
+func (s *idleBehavior) HandleIdle() *Error {
+	// 第一次空闲继续跑，第二次退出
+	if atomic.AddInt32(&s.idle, 1) < 2 {
+		return nil
+	}
+	return &Error{Code: ErrorNormalStop}
+}
+
+func TestSvr_IdleTimeout(t *testing.T) {
+	base, _ := initSvr(t)
+	var term *Error
+	svr, _ := base.mgr.NewSvr(nil, &svrBehavior{onTerm: func(reason *Error) {
+		term = reason
+	}}, WithIdleTimeout(time.Millisecond*50))
+	// 一直有消息则不会超时
+	for i := 0; i < 5; i++ {
+		svr.CallInfinity("call_echo")
+		time.Sleep(time.Millisecond * 20)
+	}
+	assert.Equal(t, svr, lookupSvr(base.mgr, svr.key))
+	<-svr.done
+	assert.Equal(t, ErrorNormalStop, term.Code)
+
+	mod := &idleBehavior{}
+	svr, _ = base.mgr.NewSvr(nil, mod, WithIdleTimeout(time.Millisecond*20))
+	<-svr.done
+	assert.Equal(t, int32(2), mod.idle)
+
+	// 只有过滤出来的消息才算活跃，别的消息一直来也会超时
+	svr, _ = base.mgr.NewSvr(nil, &svrBehavior{}, WithIdleTimeout(time.Millisecond*50), WithIdleFilter(func(msg Msg) bool {
+		return msg == "echo"
+	}))
+	for i := 0; i < 5; i++ {
+		svr.CallInfinity("echo")
+		time.Sleep(time.Millisecond * 20)
+	}
+	assert.Equal(t, svr, lookupSvr(base.mgr, svr.key))
+	deadline := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case <-svr.done:
+			done = true
+		case <-deadline:
+			t.Fatal("filtered msg still reset idle")
+		case <-time.After(time.Millisecond * 10):
+			svr.TryCast("call_echo")
+		}
+	}
+
+	// 默认不检查空闲
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, base, lookupSvr(base.mgr, base.key))
+}
+
+func TestRuntime(t *testing.T) {
+	rt1 := NewRuntime()
+	rt2 := NewRuntime()
+	assert.NotEqual(t, rt1.RootMgr(), rt2.RootMgr())
+	assert.NotEqual(t, DefaultRuntime().RootMgr(), rt1.RootMgr())
+
+	mgr1, err := NewMgr(rt1.RootMgr(), "player mgr")
+	assert.Nil(t, err)
+	mgr2, err := NewMgr(rt2.RootMgr(), "player mgr")
+	assert.Nil(t, err)
+	assert.Equal(t, rt1, mgr1.rt)
+
+	// 协程编号各自分配
+	svr1, _ := mgr1.NewSvr(nil, &svrBehavior{})
+	svr2, _ := mgr2.NewSvr(nil, &svrBehavior{})
+	assert.Equal(t, uint64(1), svr1.key)
+	assert.Equal(t, uint64(1), svr2.key)
+
+	// 分组互不影响
+	svr1.GrpReg("room")
+	assert.Equal(t, []*Svr{svr1}, rt1.GrpAll("room"))
+	assert.Equal(t, 0, len(rt2.GrpAll("room")))
+
+	// 日志各自输出
+	l := &TestLogger{}
+	rt2.SetLogger(l)
+	svr1.Cast("crash")
+	<-svr1.done
+	assert.False(t, l.in)
+	svr2.Cast("crash")
+	<-svr2.done
+	assert.True(t, l.in)
+
+	data, _ := rt1.DumpTree(1)
+	assert.Contains(t, string(data), `"name":"player mgr"`)
+	assert.Nil(t, rt1.Stop(&Error{Code: ErrorNormalStop}))
+	_, ok := LookupMgr(rt1.RootMgr(), "player mgr")
+	assert.False(t, ok)
+	_, ok = LookupMgr(rt2.RootMgr(), "player mgr")
+	assert.True(t, ok)
+}
+
+func TestGrpCast(t *testing.T) {
+	slow, _, block := newBlockSvr(t)
+	defer close(block)
+	slow.Cast(1)
+	slow.Cast(2)
+	fast, recv := newRecvSvr(t, slow.mgr)
+	self, selfRecv := newRecvSvr(t, slow.mgr)
+	dead, _ := slow.mgr.NewSvr(nil, &svrBehavior{})
+	for _, s := range []*Svr{slow, fast, self, dead} {
+		s.GrpReg("room")
+	}
+	dead.StopSvr(&Error{Code: ErrorNormalStop})
+	<-dead.done
+	// 退出的协程自动离开分组
+	waitTrue(t, func() bool { return GrpCount("room") == 3 })
+
+	// 慢的不会卡住广播
+	stats := GrpCast("room", "hello", WithExclude(self))
+	assert.Equal(t, CastStats{Delivered: 1, Dropped: 1}, stats)
+	assert.Equal(t, "hello", <-recv)
+	assert.Equal(t, 0, len(selfRecv))
+
+	stats = GrpCast("room", "hello", WithCastOverflow(OverflowBlockTimeout, time.Millisecond*10))
+	assert.Equal(t, CastStats{Delivered: 2, Dropped: 1}, stats)
+	assert.Equal(t, "hello", <-selfRecv)
+
+	stats = GrpCast("room", "hello", WithCastOverflow(OverflowDropOldest, 0))
+	assert.Equal(t, CastStats{Delivered: 3}, stats)
+
+	assert.Equal(t, CastStats{}, GrpCast("empty room", "hello"))
+}
+
+func TestGrpWatch(t *testing.T) {
+	watcher, recv := newRecvSvr(t, RootMgr())
+	watcher.GrpWatch("watch room")
+	// 没有成员的分组也能关注
+	assert.Equal(t, 0, GrpCount("watch room"))
+	assert.Nil(t, GrpAll("watch room"))
+
+	a, _ := RootMgr().NewSvr(nil, &svrBehavior{})
+	a.GrpReg("watch room")
+	joined := (<-recv).(*GroupJoined)
+	assert.Equal(t, "watch room", joined.Key)
+	assert.Equal(t, a, joined.Svr)
+
+	a.GrpUnReq("watch room")
+	left := (<-recv).(*GroupLeft)
+	assert.Equal(t, a, left.Svr)
+	assert.Equal(t, ErrorNormalStop, left.Reason.Code)
+
+	// 退出时自动离开分组，带上退出原因
+	a.GrpReg("watch room")
+	<-recv
+	a.Cast("crash")
+	left = (<-recv).(*GroupLeft)
+	assert.Equal(t, a, left.Svr)
+	assert.Equal(t, ErrorCrash, left.Reason.Code)
+	assert.Equal(t, 0, GrpCount("watch room"))
+
+	watcher.GrpUnwatch("watch room")
+	b, _ := RootMgr().NewSvr(nil, &svrBehavior{})
+	b.GrpReg("watch room")
+	b.GrpByeBye()
+	select {
+	case m := <-recv:
+		t.Fatalf("unwatch still received %v", m)
+	case <-time.After(time.Millisecond * 20):
+	}
+	// 关注者和成员都没了，分组记录也要清掉
+	sh := defaultRT.grp.shard("watch room")
+	sh.mux.RLock()
+	_, ok := sh.grps["watch room"]
+	sh.mux.RUnlock()
+	assert.False(t, ok)
+
+	// 关注者邮箱满了丢掉通知，不卡住加入的协程
+	full, _, block := newBlockSvr(t)
+	full.GrpWatch("full room")
+	for i := 0; i < 4; i++ {
+		m, _ := RootMgr().NewSvr(nil, &svrBehavior{})
+		m.GrpReg("full room")
+	}
+	assert.Equal(t, uint64(2), full.Stats().Dropped)
+	close(block)
+}
+
+func TestPubsub(t *testing.T) {
+	exact, exactRecv := newRecvSvr(t, RootMgr())
+	one, oneRecv := newRecvSvr(t, RootMgr())
+	trail, trailRecv := newRecvSvr(t, RootMgr())
+	assert.Nil(t, exact.Subscribe("room.100.chat"))
+	assert.Nil(t, one.Subscribe("room.*.system"))
+	assert.Nil(t, trail.Subscribe("room.#"))
+	// 多个订阅都匹配只收到一次
+	assert.Nil(t, trail.Subscribe("room.100.chat"))
+
+	for _, p := range []string{"", "room..chat", "room.#.chat", "room.a*", "*x"} {
+		assert.Equal(t, ErrorTopic, exact.Subscribe(p).Code, p)
+	}
+	_, err := Publish("room.*.chat", "hi")
+	assert.Equal(t, ErrorTopic, err.Code)
+
+	stats, err := Publish("room.100.chat", "chat")
+	assert.Nil(t, err)
+	assert.Equal(t, CastStats{Delivered: 2}, stats)
+	assert.Equal(t, &MsgPub{Topic: "room.100.chat", Msg: "chat"}, <-exactRecv)
+	assert.Equal(t, &MsgPub{Topic: "room.100.chat", Msg: "chat"}, <-trailRecv)
+
+	stats, _ = Publish("room.200.system", "sys")
+	assert.Equal(t, CastStats{Delivered: 2}, stats)
+	assert.Equal(t, "sys", (<-oneRecv).(*MsgPub).Msg)
+	assert.Equal(t, "sys", (<-trailRecv).(*MsgPub).Msg)
+
+	// # 也匹配零层
+	stats, _ = Publish("room", "zero")
+	assert.Equal(t, CastStats{Delivered: 1}, stats)
+	<-trailRecv
+	stats, _ = Publish("guild.1", "none")
+	assert.Equal(t, CastStats{}, stats)
+
+	one.Unsubscribe("room.*.system")
+	stats, _ = Publish("room.200.system", "sys")
+	assert.Equal(t, CastStats{Delivered: 1}, stats)
+	<-trailRecv
+
+	// 退出时自动取消订阅，前缀树也清理干净
+	trail.StopSvr(&Error{Code: ErrorNormalStop})
+	exact.StopSvr(&Error{Code: ErrorNormalStop})
+	<-trail.done
+	<-exact.done
+	stats, _ = Publish("room.100.chat", "chat")
+	assert.Equal(t, CastStats{}, stats)
+	ps := defaultRT.ps
+	ps.mux.RLock()
+	assert.Equal(t, 0, len(ps.root.children))
+	ps.mux.RUnlock()
+	assert.Equal(t, 0, GrpCount(topicKey("room.100.chat")))
+}
+
+// 收到 "later" 的调用先不回复，凭证交给测试
+type replyBehavior struct {
+	svrBehavior
+	svr    *Svr
+	tokens chan *ReplyTo
+}
+
+func (s *replyBehavior) Init(svr *Svr) *Error {
+	s.svr = svr
+	return nil
+}
+
+func (s *replyBehavior) HandleMsg(msg Msg) (interface{}, *Error) {
+	if msg == "later" {
+		s.tokens <- s.svr.ReplyTo()
+		return NoReply, nil
+	}
+	return s.svrBehavior.HandleMsg(msg)
+}
+
+func TestSvr_Reply(t *testing.T) {
+	base, _ := initSvr(t)
+	mod := &replyBehavior{tokens: make(chan *ReplyTo, 4)}
+	svr, err := base.mgr.NewSvr(nil, mod)
+	assert.Nil(t, err)
+
+	// 在别的协程里回复，期间协程可以继续处理别的消息
+	go func() {
+		to := <-mod.tokens
+		ret, err := svr.Call("echo", time.Second)
+		assert.Nil(t, err)
+		assert.True(t, Reply(to, ret, nil))
+		assert.False(t, Reply(to, "again", nil))
+	}()
+	ret, err := svr.Call("later", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo", ret)
+
+	// 没回复则调用者照常超时，之后的回复无效
+	_, err = svr.Call("later", time.Millisecond*20)
+	assert.Equal(t, ErrorTimeout, err.Code)
+	assert.False(t, Reply(<-mod.tokens, "late", nil))
+
+	// 不是在处理调用
+	assert.Nil(t, Exec(svr, func(s *replyBehavior) {
+		assert.Nil(t, s.svr.ReplyTo())
+	}))
+	assert.False(t, Reply(nil, nil, nil))
+}
+
+func TestSvr_CallAsync(t *testing.T) {
+	base, _ := initSvr(t)
+	a, _ := base.mgr.NewSvr(nil, &svrBehavior{})
+	b, _ := base.mgr.NewSvr(nil, &svrBehavior{})
+	fa := a.CallAsync("call_echo")
+	fb := b.CallAsync("echo")
+	assert.Nil(t, WaitAll(time.Second, fa, fb))
+	ret, err := fa.Await(0)
+	assert.Nil(t, err)
+	assert.Equal(t, "call_echo", ret)
+	ret, _ = fb.Await(0)
+	assert.Equal(t, "echo", ret)
+	assert.False(t, fa.Cancel())
+
+	// 慢的超时，快的先返回
+	slow := a.CallAsync("call_wait")
+	fast := b.CallAsync("echo")
+	idx, err := WaitAny(time.Millisecond*500, slow, fast)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, idx)
+	_, err = slow.Await(time.Millisecond * 10)
+	assert.Equal(t, ErrorTimeout, err.Code)
+	assert.Equal(t, ErrorTimeout, WaitAll(time.Millisecond*10, slow, fast).Code)
+	// 取消后不再处理
+	queued := a.CallAsync("call_echo")
+	assert.True(t, queued.Cancel())
+	_, err = queued.Await(0)
+	assert.Equal(t, ErrorCtxDone, err.Code)
+	ret, err = slow.Await(time.Second * 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "call_wait", ret)
+
+	// 目标退出了还没处理
+	b.Cast("crash")
+	dead := b.CallAsync("echo")
+	<-b.done
+	_, err = dead.Await(time.Second)
+	assert.Equal(t, ErrorClosed, err.Code)
+	_, err = b.CallAsync("echo").Await(time.Second)
+	assert.Equal(t, ErrorClosed, err.Code)
+
+	// 处理方延后回复
+	mod := &replyBehavior{tokens: make(chan *ReplyTo, 1)}
+	r, _ := base.mgr.NewSvr(nil, mod)
+	f := r.CallAsync("later")
+	assert.True(t, Reply(<-mod.tokens, "done", nil))
+	ret, err = f.Await(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "done", ret)
+
+	// 自己等自己
+	assert.Nil(t, Exec(r, func(s *replyBehavior) {
+		_, err := r.CallAsync("echo").Await(time.Second)
+		assert.Equal(t, ErrorDeadlock, err.Code)
+	}))
+
+	// 邮箱满了马上失败，不卡住调用者
+	full, _, block := newBlockSvr(t)
+	full.Cast(1)
+	full.Cast(2)
+	_, err = full.CallAsync("echo").Await(0)
+	assert.Equal(t, ErrorMailboxFull, err.Code)
+	close(block)
+}
+
+func TestDeadLetter(t *testing.T) {
+	// 先开协程，重置过的运行环境才装得上死信处理
+	svr, _, block := newBlockSvr(t)
+	var letters []*DeadLetter
+	var mux sync.Mutex
+	SetDeadLetterHandler(func(dl *DeadLetter) {
+		mux.Lock()
+		letters = append(letters, dl)
+		mux.Unlock()
+	})
+	defer SetDeadLetterHandler(nil)
+	before := defaultRT.DeadLetters()
+
+	// 邮箱里没处理的也算
+	svr.StopSvr(&Error{Code: ErrorNormalStop})
+	svr.Cast("left 1")
+	close(block)
+	<-svr.done
+	// 退出以后不会卡住
+	for i := 0; i < receiveChanLen*2; i++ {
+		svr.Cast(i)
+	}
+	_, err := svr.Call("echo", time.Second)
+	assert.Equal(t, ErrorClosed, err.Code)
+	assert.Equal(t, ErrorClosed, svr.TryCast("try").Code)
+	svr.StopSvr(&Error{Code: ErrorNormalStop})
+
+	n := receiveChanLen*2 + 3
+	assert.Equal(t, uint64(n), defaultRT.DeadLetters()-before)
+	mux.Lock()
+	assert.Equal(t, n, len(letters))
+	assert.Equal(t, "left 1", letters[0].Msg)
+	assert.Equal(t, svr, letters[0].Svr)
+	assert.Equal(t, "echo", letters[n-2].Msg)
+	mux.Unlock()
+
+	// 和退出赛跑的消息要么处理了，要么是死信，不会留在邮箱里
+	for round := 0; round < 20; round++ {
+		recv := make(chan Msg, 1024)
+		racer, _ := RootMgr().NewSvr(nil, &svrBehavior{recv: recv}, WithMailbox(1024))
+		before := defaultRT.DeadLetters()
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					racer.TryCast(i)
+					racer.send(i)
+				}
+			}()
+		}
+		racer.StopSvr(&Error{Code: ErrorNormalStop})
+		wg.Wait()
+		<-racer.done
+		assert.Equal(t, 800, len(recv)+int(defaultRT.DeadLetters()-before))
+	}
+}
+
+func TestSvr_SysLane(t *testing.T) {
+	// 邮箱塞满了，停止也不会卡住，而且比邮箱里的消息先处理
+	svr, recv, block := newBlockSvr(t)
+	svr.Cast(1)
+	svr.Cast(2)
+	assert.Equal(t, ErrorMailboxFull, svr.TryCast(3).Code)
+	var term *Error
+	svr.mod.(*svrBehavior).onTerm = func(reason *Error) {
+		term = reason
+	}
+	stopped := make(chan struct{})
+	go func() {
+		svr.StopSvr(&Error{Code: ErrorNormalStop})
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("StopSvr blocked by full mailbox")
+	}
+	close(block)
+	<-svr.done
+	assert.Equal(t, ErrorNormalStop, term.Code)
+	assert.Equal(t, 0, len(recv))
+
+	// 监控通知以及定时器也排在普通消息前面
+	svr, recv, block = newBlockSvr(t)
+	target, _ := svr.mgr.NewSvr(nil, &svrBehavior{})
+	svr.Cast("normal")
+	svr.Monitor(target)
+	svr.SendAfter(time.Millisecond, "timer")
+	target.StopSvr(&Error{Code: ErrorNormalStop})
+	<-target.done
+	time.Sleep(time.Millisecond * 20)
+	close(block)
+	_, ok := (<-recv).(*MsgDown)
+	assert.True(t, ok)
+	assert.Equal(t, "timer", <-recv)
+	assert.Equal(t, "normal", <-recv)
+}
+
+// 记录每一批收到的消息
+type batchBehavior struct {
+	svrBehavior
+	batches chan []Msg
+}
+
+func (s *batchBehavior) HandleBatch(msgs []Msg) *Error {
+	s.batches <- msgs
+	return nil
+}
+
+func TestSvr_Batch(t *testing.T) {
+	base, _ := initSvr(t)
+	mod := &batchBehavior{svrBehavior: svrBehavior{execRecord: map[string]string{}}, batches: make(chan []Msg, 16)}
+	svr, err := base.mgr.NewSvr(nil, mod, WithBatch(3))
+	assert.Nil(t, err)
+	// Call 不批量处理，前后的普通消息保持顺序
+	assert.Nil(t, Exec(svr, func(s *batchBehavior) {
+		go func() {
+			for i := 1; i <= 4; i++ {
+				svr.Cast(i)
+			}
+			svr.Call("echo", time.Second)
+			svr.Cast(5)
+		}()
+		// Call 返回前 5 发不出去
+		waitTrue(t, func() bool { return len(svr.receive) == 5 })
+	}))
+	assert.Equal(t, []Msg{1, 2, 3}, <-mod.batches)
+	assert.Equal(t, []Msg{4}, <-mod.batches)
+	assert.Equal(t, []Msg{5}, <-mod.batches)
+	waitTrue(t, func() bool { return svr.Stats().Handled == 7 })
+	assert.Equal(t, "echo", mod.echo)
+
+	// 没设置 WithBatch 一条一条处理
+	recv := make(chan Msg, 4)
+	plain, _ := base.mgr.NewSvr(nil, &batchBehavior{svrBehavior: svrBehavior{recv: recv}})
+	plain.Cast(1)
+	assert.Equal(t, 1, <-recv)
+}
+
+// 门：locked 时推迟 open，收到 unlock 进入 unlocked，超时自动锁上
+type doorBehavior struct {
+	log []string
+}
+
+func (d *doorBehavior) InitState(svr *Svr) (State, *Error) {
+	return "locked", nil
+}
+
+func (d *doorBehavior) States() map[State]*StateSpec {
+	return map[State]*StateSpec{
+		"locked": {
+			Enter: func(from State) *Error {
+				d.log = append(d.log, "enter locked from "+string(from))
+				return nil
+			},
+			Handle: func(msg Msg) (interface{}, State, *Error) {
+				switch msg {
+				case "unlock":
+					return "ok", "unlocked", nil
+				case "open", "jam":
+					return Postpone, "", nil
+				case "push":
+					// 推迟的同时切换状态，切过去马上重新处理
+					return Postpone, "unlocked", nil
+				case "bad":
+					return nil, "broken", nil
+				}
+				return "locked", "", nil
+			},
+		},
+		"unlocked": {
+			Exit: func(to State) {
+				d.log = append(d.log, "exit unlocked to "+string(to))
+			},
+			Handle: func(msg Msg) (interface{}, State, *Error) {
+				switch v := msg.(type) {
+				case *StateTimeout:
+					d.log = append(d.log, "timeout "+string(v.State))
+					return nil, "locked", nil
+				case string:
+					switch v {
+					case "open":
+						d.log = append(d.log, "opened")
+						return "opened", "", nil
+					case "push":
+						return "pushed", "", nil
+					case "jam":
+						return nil, "", &Error{Code: ErrorNormalStop, Param: "jammed"}
+					}
+				}
+				return "unlocked", "", nil
+			},
+			Timeout: time.Millisecond * 30,
+		},
+	}
+}
+
+func (d *doorBehavior) TerminateState(state State, reason *Error) {
+}
+
+func TestStateMachine(t *testing.T) {
+	base, _ := initSvr(t)
+	door := &doorBehavior{}
+	svr, err := base.mgr.NewSvr(nil, NewStateMachine(door))
+	assert.Nil(t, err)
+	state := func() State {
+		s, _ := CallFn(svr, func(sm *StateMachine) State { return sm.State() }, time.Second)
+		return s
+	}
+	assert.Equal(t, State("locked"), state())
+
+	// 锁着的时候开门的调用先推迟，解锁后再处理并回复
+	open := svr.CallAsync("open")
+	svr.Cast("open")
+	ret, err := svr.Call("unlock", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", ret)
+	ret, err = open.Await(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "opened", ret)
+	assert.Equal(t, State("unlocked"), state())
+
+	// 状态超时自动锁上
+	waitTrue(t, func() bool { return state() == "locked" })
+	assert.Nil(t, Exec(svr, func(sm *StateMachine) {
+		assert.Equal(t, []string{"enter locked from ", "opened", "opened",
+			"timeout unlocked", "exit unlocked to locked", "enter locked from unlocked"}, door.log)
+	}))
+
+	// 推迟并且切换状态
+	ret, err = svr.Call("push", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "pushed", ret)
+	waitTrue(t, func() bool { return state() == "locked" })
+
+	// 没有定义的状态
+	_, err = svr.Call("bad", time.Second)
+	assert.Equal(t, ErrorStateUnknown, err.Code)
+	<-svr.done
+
+	// 重新处理推迟的消息出错了，后面推迟的调用也要回复
+	svr, _ = base.mgr.NewSvr(nil, NewStateMachine(&doorBehavior{}))
+	jam := svr.CallAsync("jam")
+	open = svr.CallAsync("open")
+	svr.Cast("unlock")
+	_, err = jam.Await(time.Second)
+	assert.Equal(t, ErrorNormalStop, err.Code)
+	_, err = open.Await(time.Second)
+	assert.Equal(t, ErrorClosed, err.Code)
+	assert.Equal(t, ErrorNormalStop, err.Last.Code)
+	<-svr.done
+}
+
+// 记录收到的事件，收到 "crash" 崩溃，收到 "quit" 返回错误
+type eventRecorder struct {
+	events  []Msg
+	batches int
+	term    chan *Error
+}
+
+func (r *eventRecorder) HandleEvent(event Msg) *Error {
+	switch event {
+	case "crash":
+		panic("event crash")
+	case "quit":
+		return &Error{Code: ErrorNormalStop}
+	}
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *eventRecorder) TerminateHandler(reason *Error) {
+	r.term <- reason
+}
+
+// 不会崩溃，一次处理多个
+type batchRecorder struct {
+	eventRecorder
+}
+
+func (r *batchRecorder) HandleEvent(event Msg) *Error {
+	if event == "quit" {
+		return &Error{Code: ErrorNormalStop}
+	}
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *batchRecorder) HandleEvents(events []Msg) *Error {
+	r.batches++
+	r.events = append(r.events, events...)
+	return nil
+}
+
+func TestEventMgr(t *testing.T) {
+	base, _ := initSvr(t)
+	em, err := NewEventMgr(base.mgr, "events", WithBatch(8))
+	assert.Nil(t, err)
+	a := &eventRecorder{term: make(chan *Error, 1)}
+	b := &eventRecorder{term: make(chan *Error, 1)}
+	c := &batchRecorder{eventRecorder{term: make(chan *Error, 1)}}
+	assert.Nil(t, em.AddHandler("a", a, time.Second))
+	assert.Nil(t, em.AddHandler("b", b, time.Second))
+	assert.Nil(t, em.AddHandler("c", c, time.Second))
+	assert.Equal(t, ErrorAlreadyHad, em.AddHandler("a", a, time.Second).Code)
+
+	em.Notify(1)
+	assert.Nil(t, em.SyncNotify(2, time.Second))
+	ids, _ := em.Handlers(time.Second)
+	assert.Equal(t, []interface{}{"a", "b", "c"}, ids)
+
+	// 崩溃的处理删掉，不影响其他的，也不影响事件管理器
+	assert.Nil(t, em.SyncNotify("crash", time.Second))
+	ids, _ = em.Handlers(time.Second)
+	assert.Equal(t, []interface{}{"c"}, ids)
+	assert.Equal(t, ErrorCrash, (<-a.term).Code)
+	assert.Equal(t, ErrorCrash, (<-b.term).Code)
+	assert.Equal(t, []Msg{1, 2}, a.events)
+
+	// 主动删掉
+	assert.Nil(t, em.RemoveHandler("c", time.Second))
+	assert.Nil(t, <-c.term)
+	assert.Equal(t, ErrorNotFind, em.RemoveHandler("c", time.Second).Code)
+
+	// 批量处理
+	assert.Nil(t, em.AddHandler("c", c, time.Second))
+	started := make(chan struct{})
+	assert.Nil(t, Exec(em.Svr(), func(eb *eventBehavior) {
+		close(started)
+		// 后面还会排上 Handlers 的调用
+		waitTrue(t, func() bool { return len(em.Svr().receive) >= 4 })
+	}))
+	<-started
+	for i := 3; i <= 6; i++ {
+		em.Notify(i)
+	}
+	ids, _ = em.Handlers(time.Second)
+	assert.Equal(t, []interface{}{"c"}, ids)
+	assert.Equal(t, []Msg{1, 2, "crash", 3, 4, 5, 6}, c.events)
+	assert.Equal(t, 1, c.batches)
+
+	// 返回错误也删掉
+	em.Notify("quit")
+	assert.Equal(t, ErrorNormalStop, (<-c.term).Code)
+	ids, _ = em.Handlers(time.Second)
+	assert.Empty(t, ids)
+}
+
+func TestTask(t *testing.T) {
+	initMgr(t)
+	mgr, err := NewMgr(RootMgr(), "task mgr")
+	assert.Nil(t, err)
+
+	task := Go(mgr, context.Background(), func(ctx context.Context) (int, error) {
+		return 1, nil
+	})
+	ret, err := task.Await(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ret)
+
+	task = Go(mgr, context.Background(), func(ctx context.Context) (int, error) {
+		return 0, fmt.Errorf("task fail")
+	})
+	_, err = task.Await(time.Second)
+	assert.Equal(t, ErrorTask, err.Code)
+	assert.Equal(t, "task fail", err.Param)
+
+	l := &TestLogger{}
+	SetLogger(l)
+	defer SetLogger(nil)
+	task = Go(mgr, context.Background(), func(ctx context.Context) (int, error) {
+		panic("task crash")
+	})
+	_, err = task.Await(time.Second)
+	assert.Equal(t, ErrorCrash, err.Code)
+	assert.True(t, l.in)
+	assert.Equal(t, uint64(1), mgr.Stats().Crashes)
+
+	// 调用者的 ctx 结束或者主动取消
+	wait := func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	task = Go(mgr, ctx, wait)
+	_, err = task.Await(time.Millisecond * 10)
+	assert.Equal(t, ErrorTimeout, err.Code)
+	cancel()
+	_, err = task.Await(time.Second)
+	assert.Equal(t, ErrorTask, err.Code)
+	assert.Equal(t, ErrorCtxDone, err.Last.Code)
+	task = Go(mgr, context.Background(), wait)
+	task.Cancel()
+	<-task.Done()
+
+	// 管理器关闭时取消并等任务跑完
+	finished := int32(0)
+	task = Go(mgr, context.Background(), func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 20)
+		atomic.StoreInt32(&finished, 1)
+		return 0, nil
+	})
+	assert.Nil(t, mgr.StopMgr(&Error{Code: ErrorNormalStop}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&finished))
+	_, err = Go(mgr, context.Background(), wait).Await(time.Second)
+	assert.Equal(t, ErrorClosed, err.Code)
+
+	// 排空邮箱关闭时，一直跑的任务也会取消，不会卡住
+	mgr, _ = NewMgr(RootMgr(), "task drain")
+	svr, recv := newRecvSvr(t, mgr)
+	svr.Cast(1)
+	task = Go(mgr, context.Background(), wait)
+	assert.Nil(t, mgr.StopMgr(&Error{Code: ErrorNormalStop}, WithDrain(), WithDeadline(time.Second)))
+	assert.Equal(t, 1, <-recv)
+	_, err = task.Await(time.Second)
+	assert.Equal(t, ErrorTask, err.Code)
+
+	// 任务卡住了也会报告出来
+	mgr, _ = NewMgr(RootMgr(), "task stuck")
+	block := make(chan struct{})
+	defer close(block)
+	Go(mgr, context.Background(), func(ctx context.Context) (int, error) {
+		<-block
+		return 0, nil
+	})
+	err = mgr.StopMgr(&Error{Code: ErrorNormalStop}, WithDrain(), WithDeadline(time.Millisecond*50))
+	assert.Equal(t, ErrorTimeout, err.Code)
+	assert.Contains(t, err.Param, "1 task still running")
+}
+
+func TestPool(t *testing.T) {
+	initMgr(t)
+	recv := make(chan Msg, 64)
+	start := func() SvrBehavior {
+		return &svrBehavior{execRecord: map[string]string{}, recv: recv}
+	}
+	pool, err := NewPool(RootMgr(), "pool rr", 3, start)
+	assert.Nil(t, err)
+	// 轮流
+	seen := map[*Svr]bool{}
+	for i := 0; i < 3; i++ {
+		svr, err := pool.Pick(nil)
+		assert.Nil(t, err)
+		seen[svr] = true
+	}
+	assert.Equal(t, 3, len(seen))
+	ret, err := pool.Call(nil, "echo", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo", ret)
+
+	// 借出去的不参与轮流，都借出去了等超时
+	a, err := pool.Checkout(time.Second)
+	assert.Nil(t, err)
+	for i := 0; i < 6; i++ {
+		svr, _ := pool.Pick(nil)
+		assert.NotEqual(t, a, svr)
+	}
+	b, _ := pool.Checkout(time.Second)
+	c, _ := pool.Checkout(time.Second)
+	_, err = pool.Checkout(time.Millisecond * 10)
+	assert.Equal(t, ErrorTimeout, err.Code)
+	assert.Nil(t, pool.Checkin(b))
+	assert.Equal(t, ErrorNotFind, pool.Checkin(b).Code)
+	d, err := pool.Checkout(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, b, d)
+	pool.Checkin(a)
+	pool.Checkin(c)
+	pool.Checkin(d)
+
+	// 按 key 分派，同一个 key 总是同一个协程，崩溃了按编号重启
+	hash, _ := NewPool(RootMgr(), "pool hash", 4, start, WithDispatch(DispatchHash))
+	s1, _ := hash.Pick(int64(100))
+	s2, _ := hash.Pick(int64(100))
+	assert.Equal(t, s1, s2)
+	assert.Nil(t, hash.TryCast(int64(100), "crash"))
+	<-s1.done
+	waitTrue(t, func() bool {
+		s, err := hash.Pick(int64(100))
+		return err == nil && s != s1
+	})
+	s3, _ := hash.Pick(int64(100))
+	assert.Equal(t, s1.key, s3.key)
+	_, err = hash.Checkout(time.Second)
+	assert.Equal(t, ErrorPoolDispatch, err.Code)
+
+	// 排队最少的
+	ll, _ := NewPool(RootMgr(), "pool ll", 2, func() SvrBehavior {
+		return &svrBehavior{block: make(chan struct{})}
+	}, WithDispatch(DispatchLeastLoaded), WithWorkerOpts(WithMailbox(8)))
+	busy, _ := ll.Pick(nil)
+	busy.Cast("block")
+	waitTrue(t, func() bool { return len(busy.receive) == 0 })
+	busy.Cast(1)
+	for i := 0; i < 3; i++ {
+		svr, _ := ll.Pick(nil)
+		assert.NotEqual(t, busy, svr)
+	}
+	// TryCast 邮箱满了不等
+	assert.Nil(t, ll.TryCast(nil, 2))
+	full, _ := NewPool(RootMgr(), "pool full", 1, func() SvrBehavior {
+		return &svrBehavior{block: make(chan struct{})}
+	}, WithWorkerOpts(WithMailbox(1)))
+	assert.Nil(t, full.TryCast(nil, "block"))
+	waitTrue(t, func() bool { s, _ := full.Pick(nil); return len(s.receive) == 0 })
+	assert.Nil(t, full.TryCast(nil, 1))
+	assert.Equal(t, ErrorMailboxFull, full.TryCast(nil, 2).Code)
+
+	assert.Nil(t, pool.Mgr().StopMgr(&Error{Code: ErrorNormalStop}))
+	_, err = pool.Pick(nil)
+	assert.Equal(t, ErrorClosed, err.Code)
+	_, err = pool.Checkout(time.Second)
+	assert.Equal(t, ErrorClosed, err.Code)
+}
+
+type rejectBehavior struct {
+	svrBehavior
+}
+
+func (s *rejectBehavior) HandleMsg(msg Msg) (interface{}, *Error) {
+	return nil, &Error{Code: ErrorRejected}
+}
+
+func TestInterceptor(t *testing.T) {
+	initMgr(t)
+	var order []string
+	record := func(name string) Interceptor {
+		return func(svr *Svr, msg Msg, next Handler) (interface{}, *Error) {
+			order = append(order, name)
+			return next(msg)
+		}
+	}
+	parent, _ := NewMgr(RootMgr(), "ic parent")
+	child, _ := NewMgr(parent, "ic child")
+	parent.Use(record("parent"))
+	// 拒绝整数消息
+	child.Use(record("child"), func(svr *Svr, msg Msg, next Handler) (interface{}, *Error) {
+		if _, ok := msg.(int); ok {
+			return nil, &Error{Code: ErrorRejected}
+		}
+		return next(msg)
+	})
+	// 崩溃了不退出
+	recovered := make(chan interface{}, 1)
+	guard := Recover(func(svr *Svr, msg Msg, crash *Error) *Error {
+		recovered <- crash.ParamPanic
+		return nil
+	})
+	svr, err := child.NewSvr("ic", &svrBehavior{execRecord: map[string]string{}}, WithInterceptor(record("svr"), guard))
+	assert.Nil(t, err)
+
+	ret, err := svr.Call("echo", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo", ret)
+	assert.Equal(t, []string{"parent", "child", "svr"}, order)
+
+	_, err = svr.Call(1, time.Second)
+	assert.Equal(t, ErrorRejected, err.Code)
+	svr.Cast("crash")
+	assert.Equal(t, "test crash", <-recovered)
+	ret, err = svr.Call("echo", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo", ret)
+	assert.Equal(t, uint64(1), svr.Stats().Crashes)
+
+	// 逻辑模块自己返回 ErrorRejected 还是会退出
+	self, _ := child.NewSvr("ic self", &rejectBehavior{})
+	_, err = self.Call("reject", time.Second)
+	assert.Equal(t, ErrorRejected, err.Code)
+	<-self.done
+
+	// 批量处理的消息也一条一条过拦截器，被拒绝的不进批量
+	mod := &batchBehavior{batches: make(chan []Msg, 4)}
+	batch, _ := child.NewSvr("ic batch", mod, WithBatch(4))
+	assert.Nil(t, Exec(batch, func(s *batchBehavior) {
+		batch.Cast("a")
+		batch.Cast(1)
+		batch.Cast("b")
+	}))
+	assert.Equal(t, []Msg{"a", "b"}, <-mod.batches)
+
+	// 框架自己的消息不经过拦截器
+	order = nil
+	_, err = CallFn(svr, func(mod *svrBehavior) string { return mod.echo }, time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, order)
+}
@@ -0,0 +1,112 @@
+package gen_routine
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync/atomic"
+)
+
+// Runtime 一套独立的协程运行环境，有自己的根管理器、协程编号、分组以及日志输出
+// 包级别的接口都是操作默认的 Runtime
+type Runtime struct {
+	root   *Mgr
+	maxRId uint64
+	grp    *group
+	ps     *pubsub
+	logger Logger
+	calls  *callGraph
+
+	deadLetters uint64
+	deadHandler atomic.Value // deadHandler
+}
+
+// 默认的运行环境
+var defaultRT = NewRuntime()
+
+// NewRuntime 新建一套独立的运行环境
+func NewRuntime() *Runtime {
+	rt := &Runtime{calls: newCallGraph()}
+	rt.initRoot()
+	rt.grp = newGroup()
+	rt.ps = newPubsub(rt.grp)
+	return rt
+}
+
+// DefaultRuntime 包级别接口使用的运行环境
+func DefaultRuntime() *Runtime {
+	return defaultRT
+}
+
+func (rt *Runtime) initRoot() {
+	// 初始化全局管理器
+	rt.root = &Mgr{name: "global", rt: rt}
+	rt.root.init(context.Background())
+	atomic.StoreUint64(&rt.maxRId, 0)
+}
+
+// 分配一个新的协程编号
+func (rt *Runtime) svrKey(k interface{}) interface{} {
+	if k == nil {
+		return atomic.AddUint64(&rt.maxRId, 1)
+	}
+	return k
+}
+
+func (rt *Runtime) errorf(fmt string, args ...interface{}) {
+	if rt.logger != nil {
+		rt.logger.Errorf(fmt, args...)
+		return
+	}
+	log.Printf(fmt, args...)
+}
+
+// RootMgr 根管理器
+func (rt *Runtime) RootMgr() *Mgr {
+	return rt.root
+}
+
+// SetLogger 设置日志输出接口
+func (rt *Runtime) SetLogger(l Logger) {
+	rt.logger = l
+}
+
+// SetDeadLetterHandler 设置死信处理，为nil 则只打日志
+func (rt *Runtime) SetDeadLetterHandler(h DeadLetterHandler) {
+	rt.deadHandler.Store(deadHandler{h: h})
+}
+
+// DeadLetters 一共有多少封死信
+func (rt *Runtime) DeadLetters() uint64 {
+	return atomic.LoadUint64(&rt.deadLetters)
+}
+
+// GrpAll 获取某个分组中所有协程
+func (rt *Runtime) GrpAll(grpKey interface{}) []*Svr {
+	return rt.grp.allSvr(grpKey)
+}
+
+// GrpCast 给某个分组中所有协程投递消息，返回投递结果
+func (rt *Runtime) GrpCast(grpKey interface{}, msg Msg, opts ...CastOption) CastStats {
+	return rt.grp.cast(grpKey, msg, opts)
+}
+
+// GrpCount 某个分组中协程的数量
+func (rt *Runtime) GrpCount(grpKey interface{}) int {
+	return rt.grp.count(grpKey)
+}
+
+// Publish 发布消息到主题，所有订阅匹配的协程收到 *MsgPub
+func (rt *Runtime) Publish(topic string, msg Msg, opts ...CastOption) (CastStats, *Error) {
+	return rt.ps.publish(topic, msg, opts)
+}
+
+// DumpTree 从根管理器开始的整个管理器树运行信息，json 格式
+func (rt *Runtime) DumpTree(top int) ([]byte, error) {
+	return json.Marshal(rt.root.tree(top))
+}
+
+// Stop 关掉整个运行环境
+func (rt *Runtime) Stop(reason *Error, opts ...StopOption) *Error {
+	return rt.root.stop(reason, newStopOpts(opts))
+}
@@ -0,0 +1,141 @@
+package gen_routine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stopOpts 管理器关闭参数
+type stopOpts struct {
+	drain    bool
+	deadline time.Time // 为零值则一直等
+}
+
+// StopOption 管理器关闭参数设置
+type StopOption func(o *stopOpts)
+
+// WithDrain 先把邮箱里已经排队的消息处理完再退出
+func WithDrain() StopOption {
+	return func(o *stopOpts) {
+		o.drain = true
+	}
+}
+
+// WithDeadline 最多等 d 时间，还没退出的协程会连同堆栈一起报告出来
+func WithDeadline(d time.Duration) StopOption {
+	return func(o *stopOpts) {
+		o.deadline = time.Now().Add(d)
+	}
+}
+
+// 等待所有协程退出，withTask 则连任务一起等，超过截止时间返回 false
+// 任务要等 ctx 取消才会退出，排空邮箱时不能等它们
+func (mgr *Mgr) waitSvr(o *stopOpts, withTask bool) bool {
+	wait := func() {
+		mgr.wait.Wait()
+		if withTask {
+			mgr.tasks.Wait()
+		}
+	}
+	if o.deadline.IsZero() {
+		wait()
+		return true
+	}
+	doneChan := make(chan struct{})
+	go func() {
+		wait()
+		close(doneChan)
+	}()
+	timer := time.NewTimer(time.Until(o.deadline))
+	defer timer.Stop()
+	select {
+	case <-doneChan:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func newStopOpts(opts []StopOption) *stopOpts {
+	o := &stopOpts{}
+	for _, f := range opts {
+		f(o)
+	}
+	return o
+}
+
+// 通知所有协程处理完已经排队的消息后退出，超过截止时间返回 false
+// 停止消息走普通邮箱排在已有消息后面，不走控制通道
+func (mgr *Mgr) drainSvr(o *stopOpts, reason *Error) bool {
+	ctx := context.Background()
+	if !o.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, o.deadline)
+		defer cancel()
+	}
+	mgr.foreach(func(k interface{}, v interface{}) bool {
+		if svr, ok := v.(*Svr); ok {
+			go svr.push(ctx, &MsgStop{reason: reason}, OverflowBlock)
+		}
+		return true
+	})
+	return mgr.waitSvr(o, false)
+}
+
+// 还没退出的协程信息，带上堆栈
+func (mgr *Mgr) stuckSvr() string {
+	stacks := goroutineStacks()
+	var b strings.Builder
+	mgr.foreach(func(k interface{}, v interface{}) bool {
+		if svr, ok := v.(*Svr); ok {
+			b.WriteString(fmt.Sprintf("mgr %s svr %v stuck\n%s\n", mgr.name, k, stacks[atomic.LoadUint64(&svr.gid)]))
+		}
+		return true
+	})
+	if n := atomic.LoadInt32(&mgr.countTask); n > 0 {
+		b.WriteString(fmt.Sprintf("mgr %s %d task still running\n", mgr.name, n))
+	}
+	return b.String()
+}
+
+// 当前协程编号
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// goroutine 123 [running]:
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		id, _ := strconv.ParseUint(string(buf[:i]), 10, 64)
+		return id
+	}
+	return 0
+}
+
+// 所有协程的堆栈，key 为协程编号
+func goroutineStacks() map[uint64]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+	ret := map[uint64]string{}
+	for _, s := range strings.Split(string(buf), "\n\n") {
+		head := strings.TrimPrefix(s, "goroutine ")
+		if i := strings.IndexByte(head, ' '); i > 0 {
+			if id, err := strconv.ParseUint(head[:i], 10, 64); err == nil {
+				ret[id] = s
+			}
+		}
+	}
+	return ret
+}
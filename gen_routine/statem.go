@@ -0,0 +1,182 @@
+package gen_routine
+
+import "time"
+
+// State 状态机的状态
+type State string
+
+// StateSpec 一个状态的处理
+type StateSpec struct {
+	// Enter 进入状态时回调，from 为空表示初始状态，返回错误则协程退出
+	Enter func(from State) *Error
+	// Exit 离开状态时回调
+	Exit func(to State)
+	// Handle 这个状态下处理消息，返回下一个状态，为空则状态不变
+	// 返回 Postpone 则消息先存起来，状态变了以后再按顺序重新处理，同时返回了下一个状态则切过去马上重新处理
+	Handle func(msg Msg) (ret interface{}, next State, err *Error)
+	// Timeout 进入状态后这么久还没离开，收到 *StateTimeout，为0 则不检查
+	Timeout time.Duration
+}
+
+// StateTimeout 状态超时的消息，交给当前状态的 Handle 处理
+type StateTimeout struct {
+	State State
+	gen   uint64
+}
+
+type postpone struct{}
+
+// Postpone Handle 返回它表示这个消息推迟到状态变了以后再处理
+// 推迟的 Call 重新处理时会自动回复，不要再用 ReplyTo
+var Postpone interface{} = &postpone{}
+
+// StateMachineBehavior 状态机的逻辑模块，通过 NewStateMachine 包装成 SvrBehavior
+type StateMachineBehavior interface {
+	// InitState 协程初始化，返回初始状态
+	InitState(svr *Svr) (State, *Error)
+	// States 所有的状态
+	States() map[State]*StateSpec
+	// TerminateState 协程退出
+	TerminateState(state State, reason *Error)
+}
+
+// StateMachine 把 StateMachineBehavior 包装成 SvrBehavior
+// 可以直接作为逻辑模块，也可以嵌到自己的结构体里
+type StateMachine struct {
+	mod       StateMachineBehavior
+	svr       *Svr
+	states    map[State]*StateSpec
+	state     State
+	gen       uint64 // 每次切换状态加1，用来丢掉过期的超时
+	timer     *Timer
+	postponed []postponedMsg
+}
+
+type postponedMsg struct {
+	msg Msg
+	to  *ReplyTo // Call 推迟了以后要回复
+}
+
+// NewStateMachine 新建状态机
+func NewStateMachine(mod StateMachineBehavior) *StateMachine {
+	return &StateMachine{mod: mod}
+}
+
+// State 当前状态，只能在协程内调用
+func (sm *StateMachine) State() State {
+	return sm.state
+}
+
+// Init 实现 SvrBehavior
+func (sm *StateMachine) Init(svr *Svr) *Error {
+	sm.svr = svr
+	sm.states = sm.mod.States()
+	state, err := sm.mod.InitState(svr)
+	if err != nil {
+		return err
+	}
+	return sm.transit(state)
+}
+
+// HandleMsg 实现 SvrBehavior
+func (sm *StateMachine) HandleMsg(msg Msg) (interface{}, *Error) {
+	// 已经离开的状态的超时直接丢掉
+	if t, ok := msg.(*StateTimeout); ok && t.gen != sm.gen {
+		return nil, nil
+	}
+	ret, changed, err := sm.handleOne(msg, sm.svr.ReplyTo())
+	if err != nil {
+		return ret, err
+	}
+	if err := sm.replay(changed); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Terminate 实现 SvrBehavior
+func (sm *StateMachine) Terminate(reason *Error) {
+	sm.stopTimer()
+	sm.mod.TerminateState(sm.state, reason)
+}
+
+// HandleIdle 实现 IdleBehavior，逻辑模块没实现则直接退出
+func (sm *StateMachine) HandleIdle() *Error {
+	if idle, ok := sm.mod.(IdleBehavior); ok {
+		return idle.HandleIdle()
+	}
+	return &Error{Code: ErrorNormalStop, Param: "idle timeout"}
+}
+
+// 当前状态处理一条消息，返回状态有没有变
+func (sm *StateMachine) handleOne(msg Msg, to *ReplyTo) (interface{}, bool, *Error) {
+	ret, next, err := sm.states[sm.state].Handle(msg)
+	if err != nil {
+		return ret, false, err
+	}
+	if ret == Postpone {
+		sm.postponed = append(sm.postponed, postponedMsg{msg: msg, to: to})
+		ret = NoReply
+	}
+	if next == "" || next == sm.state {
+		return ret, false, nil
+	}
+	return ret, true, sm.transit(next)
+}
+
+// 状态变了，推迟的消息按顺序重新处理，处理中又变了则再来一遍
+// 出错了协程要退出，剩下还没处理的 Call 都回复 ErrorClosed
+func (sm *StateMachine) replay(changed bool) *Error {
+	for changed && len(sm.postponed) > 0 {
+		pending := sm.postponed
+		sm.postponed = nil
+		changed = false
+		for i, p := range pending {
+			ret, c, err := sm.handleOne(p.msg, p.to)
+			if ret != NoReply {
+				Reply(p.to, ret, err)
+			}
+			if err != nil {
+				rest := append(pending[i+1:], sm.postponed...)
+				sm.postponed = nil
+				for _, r := range rest {
+					Reply(r.to, nil, &Error{Code: ErrorClosed, Last: err})
+				}
+				return err
+			}
+			changed = changed || c
+		}
+	}
+	return nil
+}
+
+// 切换状态
+func (sm *StateMachine) transit(next State) *Error {
+	spec, ok := sm.states[next]
+	if !ok || spec.Handle == nil {
+		return &Error{Code: ErrorStateUnknown, Param: string(next)}
+	}
+	from := sm.state
+	if from != "" {
+		if cur := sm.states[from]; cur.Exit != nil {
+			cur.Exit(next)
+		}
+	}
+	sm.stopTimer()
+	sm.state = next
+	sm.gen++
+	if spec.Timeout > 0 {
+		sm.timer = sm.svr.SendAfter(spec.Timeout, &StateTimeout{State: next, gen: sm.gen})
+	}
+	if spec.Enter != nil {
+		return spec.Enter(from)
+	}
+	return nil
+}
+
+func (sm *StateMachine) stopTimer() {
+	if sm.timer != nil {
+		sm.timer.Cancel()
+		sm.timer = nil
+	}
+}
@@ -0,0 +1,164 @@
+package gen_routine
+
+import (
+	"fmt"
+	"math/bits"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 处理耗时分布，第 i 个桶记录 [2^(i-1), 2^i) 微秒的次数
+const latencyBuckets = 24
+
+type histogram struct {
+	buckets [latencyBuckets]uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := bits.Len64(uint64(d.Microseconds()))
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+}
+
+// percentile 返回 p 分位所在桶的上界
+func (h *histogram) percentile(p float64) time.Duration {
+	var counts [latencyBuckets]uint64
+	total := uint64(0)
+	for i := range h.buckets {
+		counts[i] = atomic.LoadUint64(&h.buckets[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	target := uint64(float64(total)*p + 0.5)
+	if target == 0 {
+		target = 1
+	}
+	sum := uint64(0)
+	for i, c := range counts {
+		sum += c
+		if sum >= target {
+			return time.Microsecond << uint(i)
+		}
+	}
+	return time.Microsecond << uint(latencyBuckets-1)
+}
+
+// svrStats 协程运行统计
+type svrStats struct {
+	handled uint64
+	crashes uint64
+	lastMsg atomic.Value // reflect.Type
+	latency histogram
+}
+
+// 记录一次消息处理
+func (svr *Svr) record(msg Msg, d time.Duration, err *Error) {
+	st := &svr.stats
+	atomic.AddUint64(&st.handled, 1)
+	st.latency.observe(d)
+	if call, ok := msg.(*MsgCall); ok {
+		msg = call.msg
+	}
+	if t := reflect.TypeOf(msg); t != nil {
+		st.lastMsg.Store(t)
+	}
+	if err != nil && err.Code == ErrorCrash {
+		svr.countCrash()
+	}
+}
+
+// 崩溃计数
+func (svr *Svr) countCrash() {
+	atomic.AddUint64(&svr.stats.crashes, 1)
+	atomic.AddUint64(&svr.mgr.crashes, 1)
+}
+
+// SvrStats 协程运行信息
+type SvrStats struct {
+	Key      string `json:"key"`
+	Mailbox  int    `json:"mailbox"`  // 邮箱里排队的消息数量
+	Capacity int    `json:"capacity"` // 邮箱容量
+	Handled  uint64 `json:"handled"`
+	Dropped  uint64 `json:"dropped"`
+	Crashes  uint64 `json:"crashes"`
+	LastMsg  string `json:"last_msg"`
+	P50      int64  `json:"p50_us"` // 处理耗时 p50，微秒
+	P99      int64  `json:"p99_us"`
+}
+
+// MgrStats 管理器运行信息，汇总了下面所有协程
+type MgrStats struct {
+	Name     string      `json:"name"`
+	CountSvr int32       `json:"count_svr"`
+	CountMgr int32       `json:"count_mgr"`
+	Mailbox  int         `json:"mailbox"`
+	Handled  uint64      `json:"handled"`
+	Dropped  uint64      `json:"dropped"`
+	Crashes  uint64      `json:"crashes"` // 包括已经退出的协程
+	Svrs     []*SvrStats `json:"svrs,omitempty"`
+	Children []*MgrStats `json:"children,omitempty"`
+}
+
+func (svr *Svr) statsInfo() *SvrStats {
+	st := &svr.stats
+	ret := &SvrStats{
+		Key:      fmt.Sprintf("%v", svr.key),
+		Mailbox:  len(svr.receive),
+		Capacity: cap(svr.receive),
+		Handled:  atomic.LoadUint64(&st.handled),
+		Dropped:  atomic.LoadUint64(&svr.dropped),
+		Crashes:  atomic.LoadUint64(&st.crashes),
+		P50:      st.latency.percentile(0.5).Microseconds(),
+		P99:      st.latency.percentile(0.99).Microseconds(),
+	}
+	if t, ok := st.lastMsg.Load().(reflect.Type); ok {
+		ret.LastMsg = t.String()
+	}
+	return ret
+}
+
+// 汇总管理器信息，top 大于0 则带上邮箱排队最多的 top 个协程
+func (mgr *Mgr) statsInfo(top int) *MgrStats {
+	ret := &MgrStats{
+		Name:     mgr.name,
+		CountSvr: atomic.LoadInt32(&mgr.countSvr),
+		CountMgr: atomic.LoadInt32(&mgr.countMgr),
+		Crashes:  atomic.LoadUint64(&mgr.crashes),
+	}
+	var svrs []*SvrStats
+	mgr.foreach(func(k interface{}, v interface{}) bool {
+		svr, ok := v.(*Svr)
+		if !ok {
+			return true
+		}
+		st := svr.statsInfo()
+		ret.Mailbox += st.Mailbox
+		ret.Handled += st.Handled
+		ret.Dropped += st.Dropped
+		svrs = append(svrs, st)
+		return true
+	})
+	if top > 0 {
+		sort.Slice(svrs, func(i, j int) bool { return svrs[i].Mailbox > svrs[j].Mailbox })
+		if len(svrs) > top {
+			svrs = svrs[:top]
+		}
+		ret.Svrs = svrs
+	}
+	return ret
+}
+
+// 递归汇总整个管理器树
+func (mgr *Mgr) tree(top int) *MgrStats {
+	ret := mgr.statsInfo(top)
+	for _, c := range mgr.childMgr() {
+		ret.Children = append(ret.Children, c.tree(top))
+	}
+	return ret
+}
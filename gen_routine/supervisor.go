@@ -0,0 +1,235 @@
+package gen_routine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RestartType 子协程的重启类型
+type RestartType int32
+
+const (
+	Permanent RestartType = iota // 不管什么原因退出都重启
+	Transient                    // 只有非正常退出才重启
+	Temporary                    // 从不重启
+)
+
+// Strategy 监督策略
+type Strategy int32
+
+const (
+	OneForOne  Strategy = iota // 只重启退出的那个
+	OneForAll                  // 一个退出，全部关掉再重启
+	RestForOne                 // 重启退出的那个，以及在它之后启动的
+)
+
+const (
+	defaultIntensity = 1
+	defaultPeriod    = time.Second * 5
+)
+
+// SupFlags 监督参数
+// Period 时间内重启次数超过 Intensity 则整个管理器退出
+// Period 为0时使用默认值：5秒内最多重启1次
+type SupFlags struct {
+	Strategy  Strategy
+	Intensity int
+	Period    time.Duration
+}
+
+// ChildSpec 子协程描述
+type ChildSpec struct {
+	Key     interface{}        // 为nil 则自动生成，重启后保持不变
+	Start   func() SvrBehavior // 每次(重)启动都新建一个逻辑模块
+	Restart RestartType
+	Opts    []SvrOption
+}
+
+type child struct {
+	spec ChildSpec
+	svr  *Svr // 为nil 表示当前没在跑
+}
+
+type supervisor struct {
+	flags    SupFlags
+	children []*child // 按启动顺序
+	restarts []time.Time
+	mux      sync.Mutex
+}
+
+func newSupervisor(flags SupFlags) *supervisor {
+	if flags.Period <= 0 {
+		flags.Period = defaultPeriod
+		flags.Intensity = defaultIntensity
+	}
+	return &supervisor{flags: flags}
+}
+
+// 正常退出的原因
+func isNormalReason(reason *Error) bool {
+	return reason == nil || reason.Code == ErrorCodeOk || reason.Code == ErrorNormalStop
+}
+
+func (c *child) needRestart(reason *Error) bool {
+	switch c.spec.Restart {
+	case Permanent:
+		return true
+	case Transient:
+		return !isNormalReason(reason)
+	default:
+		return false
+	}
+}
+
+// 启动一个受监督的子协程
+func (mgr *Mgr) startChild(spec ChildSpec) (*Svr, *Error) {
+	sup := mgr.sup
+	if sup == nil {
+		return nil, &Error{Code: ErrorNotSupervisor, Param: mgr.name}
+	}
+	if mgr.isStopping() {
+		return nil, &Error{Code: ErrorClosed, Param: mgr.name}
+	}
+	sup.mux.Lock()
+	defer func() {
+		sup.mux.Unlock()
+	}()
+	spec.Key = mgr.rt.svrKey(spec.Key)
+	if sup.indexOfKey(spec.Key) >= 0 {
+		v, _ := mgr.lookup(spec.Key)
+		svr, _ := v.(*Svr)
+		return svr, &Error{Code: ErrorAlreadyHad}
+	}
+	svr, err := mgr.newSvr(spec.Key, spec.Start(), spec.Opts...)
+	if err != nil {
+		return svr, err
+	}
+	sup.children = append(sup.children, &child{spec: spec, svr: svr})
+	return svr, nil
+}
+
+// 关掉某个受监督的子协程，并且不再重启
+func (mgr *Mgr) terminateChild(k interface{}, reason *Error) *Error {
+	sup := mgr.sup
+	if sup == nil {
+		return &Error{Code: ErrorNotSupervisor, Param: mgr.name}
+	}
+	sup.mux.Lock()
+	defer func() {
+		sup.mux.Unlock()
+	}()
+	idx := sup.indexOfKey(k)
+	if idx < 0 {
+		return &Error{Code: ErrorNotFind}
+	}
+	c := sup.children[idx]
+	sup.children = append(sup.children[:idx], sup.children[idx+1:]...)
+	// 子协程自己关自己，等不到自己退出，只通知不等
+	if svr := c.svr; svr != nil && mgr.rt.calls.current() == svr {
+		c.svr = nil
+		svr.send(&MsgStop{reason: reason})
+		return &Error{Code: ErrorDeadlock, Param: fmt.Sprintf("terminate child %v from itself", k)}
+	}
+	shutdownChild(c, reason)
+	return nil
+}
+
+func (sup *supervisor) indexOfKey(k interface{}) int {
+	for i, c := range sup.children {
+		if c.spec.Key == k {
+			return i
+		}
+	}
+	return -1
+}
+
+func (sup *supervisor) indexOfSvr(svr *Svr) int {
+	for i, c := range sup.children {
+		if c.svr == svr {
+			return i
+		}
+	}
+	return -1
+}
+
+// 记录一次重启，返回是否还在允许的频率内
+func (sup *supervisor) addRestart() bool {
+	now := time.Now()
+	var keep []time.Time
+	for _, t := range sup.restarts {
+		if now.Sub(t) < sup.flags.Period {
+			keep = append(keep, t)
+		}
+	}
+	sup.restarts = append(keep, now)
+	return len(sup.restarts) <= sup.flags.Intensity
+}
+
+// 通知管理器，某个子协程已经完全退出了
+func (mgr *Mgr) childExit(svr *Svr, reason *Error) {
+	if mgr.sup != nil {
+		mgr.sup.childExit(mgr, svr, reason)
+	}
+}
+
+func (sup *supervisor) childExit(mgr *Mgr, svr *Svr, reason *Error) {
+	sup.mux.Lock()
+	defer func() {
+		sup.mux.Unlock()
+	}()
+	// 找不到说明已经不是当前的子协程了，比如重启时被一起关掉的
+	idx := sup.indexOfSvr(svr)
+	if idx < 0 {
+		return
+	}
+	c := sup.children[idx]
+	c.svr = nil
+	// 管理器正在关闭，不需要重启
+	if mgr.isStopping() || mgr.ctx.Err() != nil {
+		return
+	}
+	if !c.needRestart(reason) {
+		sup.children = append(sup.children[:idx], sup.children[idx+1:]...)
+		return
+	}
+	if !sup.addRestart() {
+		mgr.rt.errorf("supervisor %s reached max restart intensity, child %v reason %s", mgr.name, c.spec.Key, reason.String())
+		go mgr.stop(&Error{Code: ErrorRestartLimit, Last: reason}, &stopOpts{})
+		return
+	}
+	var targets []*child
+	switch sup.flags.Strategy {
+	case OneForAll:
+		targets = sup.children
+	case RestForOne:
+		targets = sup.children[idx:]
+	default:
+		targets = sup.children[idx : idx+1]
+	}
+	// 先按启动的反序关掉，再按顺序重启
+	for i := len(targets) - 1; i >= 0; i-- {
+		shutdownChild(targets[i], &Error{Code: ErrorShutdown, Last: reason})
+	}
+	for _, t := range targets {
+		s, err := mgr.newSvr(t.spec.Key, t.spec.Start(), t.spec.Opts...)
+		if err != nil {
+			// 重启不起来和重启太频繁一样，整个管理器退出
+			mgr.rt.errorf("supervisor %s restart child %v fail %s", mgr.name, t.spec.Key, err.String())
+			go mgr.stop(&Error{Code: ErrorRestartLimit, Param: fmt.Sprintf("restart child %v fail", t.spec.Key), Last: err}, &stopOpts{})
+			return
+		}
+		t.svr = s
+	}
+}
+
+// 关掉子协程并等它完全退出
+func shutdownChild(c *child, reason *Error) {
+	svr := c.svr
+	if svr == nil {
+		return
+	}
+	c.svr = nil
+	svr.send(&MsgStop{reason: reason})
+	<-svr.done
+}
@@ -1,8 +1,11 @@
 package gen_routine
 
 import (
+	"context"
 	"reflect"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +16,45 @@ type Svr struct {
 	receive chan Msg
 	mgr     *Mgr
 	mod     SvrBehavior
+	handler Handler       // 包了拦截器的 HandleMsg
+	collect Handler       // 包了拦截器的批量收集，没有拦截器时为nil
+	done    chan struct{} // 协程完全退出后关闭
+	opts    svrOpts
+	dropped uint64 // 邮箱满了丢掉的消息数量
+	gid     uint64 // 跑 loop 的协程编号
+	busy    int32  // 是否正在处理消息
+	stats   svrStats
+
+	// 监控以及链接关系
+	relMux   sync.Mutex
+	exited   bool
+	monitors map[*MonitorRef]*Svr
+	links    map[*Svr]bool
+	trapExit bool
+
+	curCall *MsgCall // 当前正在处理的调用
+
+	// 控制通道，停止、监控通知以及定时器走这里，比邮箱里的消息先处理
+	// 不限长度，发送方永远不会卡住
+	sysMux    sync.Mutex
+	sysQ      []Msg
+	sysC      chan struct{}
+	sysClosed bool // 协程退出了，不再接收控制消息
+
+	// 在哪些分组里，以及关注了哪些分组
+	grpMux sync.Mutex
+	grps   map[interface{}]bool
+	watch  map[interface{}]bool
+
+	// 定时器
+	timerMux    sync.Mutex
+	timers      map[*Timer]bool
+	timerClosed bool
+
+	active   bool   // 这次处理的消息里有算活跃的，只在 loop 里用
+	batchBuf []Msg  // 批量处理时拦截器放行的消息，只在 loop 里用
+	modErr   *Error // 逻辑模块返回的错误，用来区分是不是拦截器拒绝的
+	rejected *Error // 拦截器拒绝消息返回的错误，不让协程退出
 }
 
 type MsgRet struct {
@@ -25,8 +67,12 @@ type MsgStop struct {
 }
 
 type MsgCall struct {
-	msg     Msg
-	retChan chan *MsgRet
+	msg       Msg
+	retChan   chan *MsgRet
+	ctx       context.Context // 调用者的 context
+	abandoned int32           // 调用者检测到死锁已经放弃了
+	replied   int32           // 已经回复过了
+	fut       *Future         // 异步调用，结果放到这里
 }
 
 type MsgExec struct {
@@ -39,7 +85,7 @@ type Msg interface{}
 
 func (svr *Svr) start(mgr *Mgr) *Error {
 	// 接收chan 加缓存是因为非阻塞式的自己给自己发消息能够写起来比较简单
-	svr.receive = make(chan Msg, receiveChanLen)
+	svr.receive = make(chan Msg, svr.opts.mailbox)
 	svr.mgr = mgr
 	startOkChan := make(chan *Error)
 	svr.mgr.wait.Add(1)
@@ -48,6 +94,38 @@ func (svr *Svr) start(mgr *Mgr) *Error {
 	return startRet
 }
 
+// 处理一条消息，返回错误则协程退出
+func (svr *Svr) process(msg Msg) *Error {
+	atomic.StoreInt32(&svr.busy, 1)
+	svr.rejected = nil
+	start := time.Now()
+	_, err := svr.handle(msg)
+	svr.record(msg, time.Since(start), err)
+	// 被拦截器拒绝的消息不影响协程
+	if err != nil && err.Code != ErrorCodeOk && err != svr.rejected {
+		return err
+	}
+	return nil
+}
+
+// 处理控制通道里所有的消息，返回错误则协程退出，剩下的控制消息退出时转成死信
+func (svr *Svr) handleSys() *Error {
+	for {
+		svr.sysMux.Lock()
+		if len(svr.sysQ) == 0 {
+			svr.sysMux.Unlock()
+			return nil
+		}
+		msg := svr.sysQ[0]
+		svr.sysQ[0] = nil
+		svr.sysQ = svr.sysQ[1:]
+		svr.sysMux.Unlock()
+		if err := svr.process(msg); err != nil {
+			return err
+		}
+	}
+}
+
 func (svr *Svr) loop(startOkChan chan *Error) {
 	reason := &Error{Code: ErrorCodeOk}
 	defer func() {
@@ -57,35 +135,114 @@ func (svr *Svr) loop(startOkChan chan *Error) {
 		//	reason = &Error{Code: ErrorCrash, ParamPanic: r, Param: string(debug.Stack())}
 		//	errorf("svr loop crash %v \n%s", reason.ParamPanic, reason.Param)
 		//}
-		svr.mgr.wait.Done()
+		// Terminate 也算在管理器的等待里，关管理器时要等它处理完
+		// Terminate 里还算在这个协程里，在里面关自己的管理器不会卡住
 		svr.stop(reason)
+		svr.mgr.rt.calls.unbind(svr.gid)
+		svr.mgr.wait.Done()
 	}()
+	atomic.StoreUint64(&svr.gid, goroutineID())
+	svr.mgr.rt.calls.bind(svr.gid, svr)
+	atomic.StoreInt32(&svr.busy, 1)
 	if e := svr.behaviorInit(startOkChan); e != nil {
 		reason = e
 		return
 	}
+	// 空闲超时检查
+	var idle *time.Timer
+	var idleC <-chan time.Time
+	if svr.opts.idle > 0 {
+		idle = time.NewTimer(svr.opts.idle)
+		defer idle.Stop()
+		idleC = idle.C
+	}
+	// 批量处理
+	batch, _ := svr.mod.(BatchBehavior)
+	if svr.opts.batch < 2 {
+		batch = nil
+	}
 LOOP:
 	for {
+		atomic.StoreInt32(&svr.busy, 0)
+		// 控制消息优先处理
+		select {
+		case <-svr.sysC:
+			if err := svr.handleSys(); err != nil {
+				reason = err
+				break LOOP
+			}
+			continue
+		default:
+		}
 		select {
 		case <-svr.mgr.ctx.Done():
-			reason = &Error{Code: ErrorCtxDone}
+			reason = svr.mgr.ctxReason()
 			break LOOP
+		case <-svr.sysC:
+			if err := svr.handleSys(); err != nil {
+				reason = err
+				break LOOP
+			}
 		case msg := <-svr.receive: // 处理发进来的消息
-			_, err := svr.handle(msg)
-			// 返回错误，则退出
-			if err != nil && err.Code != ErrorCodeOk {
+			svr.active = false
+			if err := svr.processMailbox(batch, msg); err != nil {
 				reason = err
 				break LOOP
 			}
+			if idle != nil && svr.active {
+				if !idle.Stop() {
+					select {
+					case <-idle.C:
+					default:
+					}
+				}
+				idle.Reset(svr.opts.idle)
+			}
+		case <-idleC:
+			atomic.StoreInt32(&svr.busy, 1)
+			if err := svr.handleIdle(); err != nil && err.Code != ErrorCodeOk {
+				reason = err
+				break LOOP
+			}
+			idle.Reset(svr.opts.idle)
 		}
 	}
 }
 
+// 收到的消息算不算活跃
+func (svr *Svr) touch(msg Msg) {
+	if svr.opts.idleIf == nil {
+		svr.active = true
+		return
+	}
+	if call, ok := msg.(*MsgCall); ok {
+		msg = call.msg
+	}
+	if svr.opts.idleIf(msg) {
+		svr.active = true
+	}
+}
+
+// handleIdle 空闲超时回调
+func (svr *Svr) handleIdle() (reason *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			reason = &Error{Code: ErrorCrash, ParamPanic: r, Param: string(debug.Stack())}
+			svr.mgr.rt.errorf("svr handle idle crash %v \n%s", reason.ParamPanic, reason.Param)
+		}
+	}()
+	idle, ok := svr.mod.(IdleBehavior)
+	if !ok {
+		return &Error{Code: ErrorNormalStop, Param: "idle timeout"}
+	}
+	return idle.HandleIdle()
+}
+
 func (svr *Svr) behaviorInit(startOkChan chan *Error) (reason *Error) {
 	defer func() {
 		if r := recover(); r != nil {
 			reason = &Error{Code: ErrorCrash, ParamPanic: r, Param: string(debug.Stack())}
-			errorf("svr behaviorInit crash %v \n%s", reason.ParamPanic, reason.Param)
+			svr.mgr.rt.errorf("svr behaviorInit crash %v \n%s", reason.ParamPanic, reason.Param)
 		}
 		startOkChan <- reason
 	}()
@@ -102,33 +259,200 @@ func (svr *Svr) handle(msg Msg) (ret interface{}, reason *Error) {
 	defer func() {
 		if r := recover(); r != nil {
 			reason = &Error{Code: ErrorCrash, ParamPanic: r, Param: string(debug.Stack())}
-			errorf("svr handle msg crash %v \n%s", reason.ParamPanic, reason.Param)
+			svr.mgr.rt.errorf("svr handle msg crash %v \n%s", reason.ParamPanic, reason.Param)
 		}
 	}()
 	switch v := msg.(type) {
 	case *MsgCall:
+		// 调用者已经不等了，直接丢掉
+		if v.ctx.Err() != nil || atomic.LoadInt32(&v.abandoned) == 1 {
+			return nil, nil
+		}
+		last := svr.curCall
+		svr.curCall = v
 		ret, err := svr.handle(v.msg)
-		v.retChan <- &MsgRet{ret: ret, err: err}
+		svr.curCall = last
+		// 返回 NoReply 的由 Reply 稍后回复
+		if ret != NoReply || err != nil {
+			v.reply(ret, err)
+		}
 		return ret, err
 	case *MsgStop:
 		return nil, v.reason
 	case *MsgExec:
 		return handleExec(v)
+	case *MsgFn:
+		return svr.handleFn(v)
 	default:
-		return svr.mod.HandleMsg(v)
+		return svr.intercept(v)
 	}
 }
 
-func (svr *Svr) call(msg Msg, timeout time.Duration) (interface{}, *Error) {
-	retChan := make(chan *MsgRet)
-	callMsg := &MsgCall{msg: msg, retChan: retChan}
-	svr.receive <- callMsg
+// send 往协程发消息，协程已经退出了则转成死信并返回 false，不会一直卡住
+func (svr *Svr) send(msg Msg) bool {
+	svr.sysMux.Lock()
+	// 退出时清理过控制通道就不能再放进去了，不然永远没人处理
+	if svr.sysClosed {
+		svr.sysMux.Unlock()
+		svr.closed(msg)
+		return false
+	}
+	svr.sysQ = append(svr.sysQ, msg)
+	svr.sysMux.Unlock()
+	select {
+	case svr.sysC <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// 协程已经退出，消息转成死信
+func (svr *Svr) closed(msg Msg) *Error {
+	svr.mgr.rt.deadLetter(svr, msg)
+	return &Error{Code: ErrorClosed}
+}
+
+// push 按邮箱满了之后的策略投递消息，协程退出了返回 ErrorClosed，消息转成死信
+// ctx 是 OverflowBlock 时等待的截止
+func (svr *Svr) push(ctx context.Context, msg Msg, policy Overflow) *Error {
+	err := svr.enqueue(ctx, msg, policy)
+	if err == nil {
+		// 放进去的时候协程可能刚好退出，退出时已经清理过邮箱了，再清理一次
+		select {
+		case <-svr.done:
+			svr.drainMailbox()
+		default:
+		}
+	}
+	return err
+}
+
+func (svr *Svr) enqueue(ctx context.Context, msg Msg, policy Overflow) *Error {
 	select {
-	case <-time.After(timeout):
-		return nil, &Error{Code: ErrorTimeout}
-	case ret := <-retChan:
-		return ret.ret, ret.err
+	case <-svr.done:
+		return svr.closed(msg)
+	default:
+	}
+	switch policy {
+	case OverflowBlock:
+		select {
+		case svr.receive <- msg:
+			return nil
+		case <-svr.done:
+			return svr.closed(msg)
+		case <-ctx.Done():
+			return ctxError(ctx)
+		}
+	case OverflowBlockTimeout:
+		timer := time.NewTimer(svr.opts.timeout)
+		defer timer.Stop()
+		select {
+		case svr.receive <- msg:
+			return nil
+		case <-svr.done:
+			return svr.closed(msg)
+		case <-timer.C:
+			return &Error{Code: ErrorTimeout}
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case svr.receive <- msg:
+				return nil
+			default:
+			}
+			select {
+			case old := <-svr.receive:
+				svr.evict(old)
+			default:
+			}
+		}
+	default:
+		select {
+		case svr.receive <- msg:
+			return nil
+		default:
+		}
+		atomic.AddUint64(&svr.dropped, 1)
+		if policy == OverflowDropNewest {
+			return nil
+		}
+		return &Error{Code: ErrorMailboxFull}
+	}
+}
+
+// 邮箱满了挤掉的老消息，调用要回复调用者，停止消息改走控制通道
+func (svr *Svr) evict(msg Msg) {
+	switch v := msg.(type) {
+	case *MsgCall:
+		v.reply(nil, &Error{Code: ErrorMailboxFull})
+	case *MsgStop:
+		svr.send(v)
+		return
+	}
+	atomic.AddUint64(&svr.dropped, 1)
+}
+
+// 调用投递的策略，调用不能悄悄丢掉
+// OverflowDropNewest 改成直接返回 ErrorMailboxFull，其他的不会丢调用
+func (svr *Svr) callPolicy() Overflow {
+	if svr.opts.overflow == OverflowDropNewest {
+		return OverflowError
+	}
+	return svr.opts.overflow
+}
+
+func (svr *Svr) call(msg Msg, timeout time.Duration) (interface{}, *Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return svr.callCtx(ctx, msg)
+}
+
+func (svr *Svr) callCtx(ctx context.Context, msg Msg) (interface{}, *Error) {
+	// 目标正在处理消息时才可能是自己调自己，这时才去查当前所在的协程
+	if atomic.LoadInt32(&svr.busy) == 1 && svr.mgr.rt.calls.current() == svr {
+		return nil, &Error{Code: ErrorDeadlock, Param: "call chain : " + callChain([]*Svr{svr, svr})}
+	}
+	// 带一个缓存，调用者不等了，处理方也不会卡住
+	retChan := make(chan *MsgRet, 1)
+	callMsg := &MsgCall{msg: msg, retChan: retChan, ctx: ctx}
+	if err := svr.push(ctx, callMsg, svr.callPolicy()); err != nil {
+		return nil, err
+	}
+	// 等了一小会还没返回，才去检查是不是形成了环
+	check := time.NewTimer(deadlockCheckDelay)
+	defer check.Stop()
+	for {
+		select {
+		case <-check.C:
+			if caller := svr.mgr.rt.calls.current(); caller != nil {
+				if err := svr.mgr.rt.calls.enter(caller, svr); err != nil {
+					atomic.StoreInt32(&callMsg.abandoned, 1)
+					return nil, err
+				}
+				defer svr.mgr.rt.calls.leave(caller)
+			}
+		case <-ctx.Done():
+			return nil, ctxError(ctx)
+		case ret := <-retChan:
+			return ret.ret, ret.err
+		case <-svr.done:
+			select {
+			case ret := <-retChan:
+				return ret.ret, ret.err
+			default:
+				return nil, &Error{Code: ErrorClosed}
+			}
+		}
+	}
+}
+
+// ctxError context 结束的原因转成错误码
+func ctxError(ctx context.Context) *Error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &Error{Code: ErrorTimeout}
 	}
+	return &Error{Code: ErrorCtxDone}
 }
 
 // handleExec 处理直接走协程调用某个函数的情况
@@ -145,10 +469,16 @@ func (svr *Svr) stop(reason *Error) (ret *Error) {
 	defer func() {
 		if r := recover(); r != nil {
 			ret = &Error{Code: ErrorCrash, ParamPanic: r, Param: string(debug.Stack())}
-			errorf("svr stop crash %v \n%s", ret.ParamPanic, ret.Param)
+			svr.mgr.rt.errorf("svr stop crash %v \n%s", ret.ParamPanic, ret.Param)
 		}
 		svr.mgr.svrTerminate(svr)
+		close(svr.done)
+		svr.drainDead()
+		svr.mgr.rt.ps.bye(svr, reason)
+		svr.notifyExit(reason)
+		svr.mgr.childExit(svr, reason)
 	}()
+	svr.stopTimers()
 	svr.mod.Terminate(reason)
 	return
 }
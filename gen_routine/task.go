@@ -0,0 +1,78 @@
+package gen_routine
+
+import (
+	"context"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// Task 管理器下跑的任务，可以等结果，也可以取消
+// 管理器关闭时会取消任务的 ctx，并且等任务跑完
+type Task[T any] struct {
+	mgr    *Mgr
+	cancel context.CancelFunc
+	done   chan struct{}
+	ret    T
+	err    *Error
+}
+
+func goTask[T any](mgr *Mgr, ctx context.Context, f func(ctx context.Context) (T, error)) *Task[T] {
+	t := &Task[T]{mgr: mgr, done: make(chan struct{})}
+	if mgr.isStopping() || mgr.ctx.Err() != nil {
+		t.cancel = func() {}
+		t.err = &Error{Code: ErrorClosed, Param: mgr.name}
+		close(t.done)
+		return t
+	}
+	// 管理器的 ctx 以及调用者的 ctx 任意一个结束都取消任务
+	tctx, cancel := context.WithCancel(mgr.ctx)
+	t.cancel = cancel
+	if ctx != nil && ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-tctx.Done():
+			}
+		}()
+	}
+	mgr.tasks.Add(1)
+	atomic.AddInt32(&mgr.countTask, 1)
+	go t.run(tctx, f)
+	return t
+}
+
+func (t *Task[T]) run(ctx context.Context, f func(ctx context.Context) (T, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.err = &Error{Code: ErrorCrash, ParamPanic: r, Param: string(debug.Stack())}
+			atomic.AddUint64(&t.mgr.crashes, 1)
+			t.mgr.rt.errorf("task in %s crash %v \n%s", t.mgr.name, t.err.ParamPanic, t.err.Param)
+		}
+		t.cancel()
+		close(t.done)
+		atomic.AddInt32(&t.mgr.countTask, -1)
+		t.mgr.tasks.Done()
+	}()
+	ret, err := f(ctx)
+	t.ret = ret
+	if err != nil {
+		t.err = &Error{Code: ErrorTask, Param: err.Error()}
+		if ctx.Err() != nil {
+			t.err.Last = ctxError(ctx)
+		}
+	}
+}
+
+func (t *Task[T]) await(timeout time.Duration) (T, *Error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return t.ret, t.err
+	case <-timer.C:
+		var r T
+		return r, &Error{Code: ErrorTimeout}
+	}
+}
@@ -0,0 +1,81 @@
+package gen_routine
+
+import "time"
+
+// Timer 协程定时器，到时间后往所属协程发消息
+type Timer struct {
+	svr      *Svr
+	t        *time.Timer
+	interval time.Duration // 大于0 则是周期定时器
+	msg      Msg
+}
+
+// 开启一个定时器
+func (svr *Svr) startTimer(d time.Duration, interval time.Duration, msg Msg) *Timer {
+	tm := &Timer{svr: svr, interval: interval, msg: msg}
+	svr.timerMux.Lock()
+	defer func() {
+		svr.timerMux.Unlock()
+	}()
+	// 协程已经退出了，定时器不会触发
+	if svr.timerClosed {
+		return tm
+	}
+	if svr.timers == nil {
+		svr.timers = map[*Timer]bool{}
+	}
+	svr.timers[tm] = true
+	tm.t = time.AfterFunc(d, tm.fire)
+	return tm
+}
+
+func (tm *Timer) fire() {
+	svr := tm.svr
+	svr.timerMux.Lock()
+	if !svr.timers[tm] {
+		svr.timerMux.Unlock()
+		return
+	}
+	if tm.interval <= 0 {
+		delete(svr.timers, tm)
+	}
+	svr.timerMux.Unlock()
+
+	svr.send(tm.msg)
+
+	if tm.interval > 0 {
+		svr.timerMux.Lock()
+		if svr.timers[tm] {
+			tm.t.Reset(tm.interval)
+		}
+		svr.timerMux.Unlock()
+	}
+}
+
+// 取消定时器，返回定时器取消前是否还有效
+func (tm *Timer) cancel() bool {
+	svr := tm.svr
+	svr.timerMux.Lock()
+	defer func() {
+		svr.timerMux.Unlock()
+	}()
+	active := svr.timers[tm]
+	delete(svr.timers, tm)
+	if tm.t != nil {
+		tm.t.Stop()
+	}
+	return active
+}
+
+// 协程退出，清理所有定时器
+func (svr *Svr) stopTimers() {
+	svr.timerMux.Lock()
+	defer func() {
+		svr.timerMux.Unlock()
+	}()
+	svr.timerClosed = true
+	for tm := range svr.timers {
+		tm.t.Stop()
+	}
+	svr.timers = nil
+}